@@ -0,0 +1,177 @@
+// Package accounts keeps the server's registered users in a JSON file.
+// Passwords are stored as salted PBKDF2-HMAC-SHA256 hashes.
+package accounts
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	saltSize          = 16
+	keySize           = 32
+	defaultIterations = 100000
+
+	// MinPasswordLength is the shortest password Register accepts.
+	MinPasswordLength = 6
+)
+
+var (
+	ErrExists       = errors.New("accounts: username is already registered")
+	ErrWeakPassword = fmt.Errorf("accounts: password must be at least %d characters", MinPasswordLength)
+)
+
+// Account is a registered user as stored on disk.
+type Account struct {
+	Salt       []byte    `json:"salt"`
+	Hash       []byte    `json:"hash"`
+	Iterations int       `json:"iterations"`
+	Created    time.Time `json:"created"`
+}
+
+// Store is a file-backed set of accounts. It is safe for concurrent use.
+// Usernames are not case sensitive: "Alice" and "alice" are one account.
+type Store struct {
+	path  string
+	mu    sync.Mutex
+	users map[string]*Account // by key(username)
+}
+
+// key is the form usernames are stored and looked up in.
+func key(username string) string {
+	return strings.ToLower(username)
+}
+
+// Open loads the store at path. A missing file is treated as an empty store
+// and created on the first Register.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, users: make(map[string]*Account)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var users map[string]*Account
+	if err := json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("accounts: reading %s: %w", path, err)
+	}
+	for username, account := range users {
+		if _, ok := s.users[key(username)]; ok {
+			return nil, fmt.Errorf("accounts: reading %s: %s is registered more than once", path, key(username))
+		}
+		s.users[key(username)] = account
+	}
+	return s, nil
+}
+
+// Exists reports whether username is registered.
+func (s *Store) Exists(username string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.users[key(username)]
+	return ok
+}
+
+// Register adds a new account and writes the store to disk.
+func (s *Store) Register(username, password string) error {
+	if len(password) < MinPasswordLength {
+		return ErrWeakPassword
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	account := &Account{
+		Salt:       salt,
+		Hash:       pbkdf2([]byte(password), salt, defaultIterations, keySize),
+		Iterations: defaultIterations,
+		Created:    time.Now().UTC(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[key(username)]; ok {
+		return ErrExists
+	}
+	s.users[key(username)] = account
+	if err := s.save(); err != nil {
+		delete(s.users, key(username))
+		return err
+	}
+	return nil
+}
+
+// Verify reports whether password is correct for username.
+func (s *Store) Verify(username, password string) bool {
+	s.mu.Lock()
+	account, ok := s.users[key(username)]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	hash := pbkdf2([]byte(password), account.Salt, account.Iterations, len(account.Hash))
+	return subtle.ConstantTimeCompare(hash, account.Hash) == 1
+}
+
+// save writes the store atomically. It must be called with mu held.
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(s.path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// pbkdf2 derives a key as described in RFC 8018 using HMAC-SHA256.
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var counter [4]byte
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], uint32(block))
+		prf.Write(counter[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for n := 2; n <= iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
@@ -0,0 +1,68 @@
+package accounts
+
+import (
+	"bytes"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+)
+
+// The PBKDF2-HMAC-SHA256 test vectors from RFC 7914, section 11, and the
+// widely published ones following RFC 6070's inputs.
+var pbkdf2Vectors = []struct {
+	password, salt string
+	iterations     int
+	key            string
+}{
+	{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+	{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+	{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+	{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+}
+
+func TestPBKDF2(t *testing.T) {
+	for _, v := range pbkdf2Vectors {
+		want, _ := hex.DecodeString(v.key)
+		got := pbkdf2([]byte(v.password), []byte(v.salt), v.iterations, len(want))
+		if !bytes.Equal(got, want) {
+			t.Errorf("pbkdf2(%q, %q, %d) = %x, want %x", v.password, v.salt, v.iterations, got, want)
+		}
+	}
+}
+
+func TestRegisterAndVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register("alice", "short"); err != ErrWeakPassword {
+		t.Fatalf("Register with a short password: got %v, want ErrWeakPassword", err)
+	}
+	if err := s.Register("alice", "hunter22"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Register("Alice", "hunter33"); err != ErrExists {
+		t.Fatalf("Register of a taken name: got %v, want ErrExists", err)
+	}
+
+	// Reopening reads back what Register saved
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Exists("ALICE") {
+		t.Error("alice does not exist after reopening")
+	}
+	if !s.Verify("Alice", "hunter22") {
+		t.Error("the right password was refused")
+	}
+	if s.Verify("alice", "hunter23") {
+		t.Error("a wrong password was accepted")
+	}
+	if s.Verify("bob", "hunter22") {
+		t.Error("a password was accepted for an unknown user")
+	}
+}
@@ -0,0 +1,117 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/cameroncuttingedge/terminal-chat/chat/accounts"
+	"github.com/cameroncuttingedge/terminal-chat/chat/protocol"
+)
+
+// authError is returned by authenticate with the code to reject the login with.
+type authError struct {
+	code    string
+	message string
+}
+
+func (e *authError) Error() string {
+	return e.message
+}
+
+const maxUsernameLength = 32
+
+// usernameKey is the form usernames are compared in: names that differ only
+// in case are the same name, so nobody can pass for someone else.
+func usernameKey(username string) string {
+	return strings.ToLower(username)
+}
+
+// systemName is who server notices appear to come from, as in
+// "Robot: alice has joined #lobby.", so nobody may pose as it.
+const systemName = "Robot"
+
+// validateUsername keeps names plain so they can be shown anywhere, including
+// inside server notices, without being mistaken for markup or for the server.
+func validateUsername(username string) error {
+	if username == "" {
+		return errors.New("Username must not be empty.")
+	}
+	if strings.EqualFold(strings.TrimRight(username, ":"), systemName) {
+		return fmt.Errorf("%s is reserved for the server.", username)
+	}
+	if len(username) > maxUsernameLength {
+		return fmt.Errorf("Username must be at most %d characters.", maxUsernameLength)
+	}
+	for _, r := range username {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || r == '[' || r == ']' {
+			return errors.New("Username must not contain spaces or brackets.")
+		}
+	}
+	return nil
+}
+
+// authenticate checks a hello against the user store. Registered names always
+// need their password, even while the owner is offline; everyone else is a
+// guest unless the server requires accounts.
+func (s *Server) authenticate(username, password string) (registered bool, err error) {
+	if s.cfg.Users != nil && s.cfg.Users.Exists(username) {
+		if password == "" {
+			return false, &authError{protocol.CodeAuthRequired, fmt.Sprintf("%s is a registered account, log in with its password.", username)}
+		}
+		if !s.cfg.Users.Verify(username, password) {
+			return false, &authError{protocol.CodeAuthFailed, fmt.Sprintf("Wrong password for %s.", username)}
+		}
+		return true, nil
+	}
+	if s.config().RequireAuth {
+		return false, &authError{protocol.CodeAuthRequired, "This server only accepts registered accounts."}
+	}
+	return false, nil
+}
+
+// cmdRegister runs /register <password>.
+func cmdRegister(s *Server, c *client, args []string) {
+	if s.cfg.Users == nil {
+		c.sendError(protocol.CodeBadRequest, "Accounts are not enabled on this server.")
+		return
+	}
+	if s.isOperator(c.username) {
+		// Otherwise the first guest to pick the name would become operator
+		c.sendError(protocol.CodePermissionDenied, fmt.Sprintf("%s is reserved for an operator; ask the server's owner to create the account.", c.username))
+		return
+	}
+
+	err := s.cfg.Users.Register(c.username, args[0])
+	switch {
+	case errors.Is(err, accounts.ErrExists):
+		c.sendError(protocol.CodeBadRequest, fmt.Sprintf("%s is already registered.", c.username))
+	case errors.Is(err, accounts.ErrWeakPassword):
+		c.sendError(protocol.CodeBadRequest, fmt.Sprintf("Passwords must be at least %d characters.", accounts.MinPasswordLength))
+	case err != nil:
+		s.logger.Printf("[Server] Failed to register '%s': %v", c.username, err)
+		c.sendError(protocol.CodeBadRequest, "Registration failed, please try again later.")
+	default:
+		s.logger.Printf("[Server] Registered account '%s'", c.username)
+		c.enqueue(alertMessage(fmt.Sprintf("%s is now registered. Log in with your password next time.", c.username)))
+	}
+}
+
+// redactSecrets hides the arguments of secret commands, such as the password
+// in /register, so they never reach the logs.
+func (s *Server) redactSecrets(message string) string {
+	name, line := splitCommand(strings.TrimSpace(message))
+	if cmd := s.commands.lookup(name); cmd != nil && cmd.secret && line != "" {
+		return cmd.name + " ********"
+	}
+	return message
+}
+
+// isRegisterCommand reports whether message is a /register command, however
+// it is capitalised or spaced. The client uses it to keep passwords out of
+// its logs.
+func isRegisterCommand(message string) bool {
+	name, _ := splitCommand(strings.TrimSpace(message))
+	return strings.EqualFold(name, "/register")
+}
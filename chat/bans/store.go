@@ -0,0 +1,162 @@
+// Package bans keeps the server's bans in a JSON file. A ban names either a
+// username or an IP address and may expire.
+package bans
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ban keeps a username or an address off the server.
+type Ban struct {
+	Username string    `json:"username,omitempty"`
+	IP       string    `json:"ip,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	By       string    `json:"by"`
+	Created  time.Time `json:"created"`
+	// Expires is when the ban lifts. The zero time means never.
+	Expires time.Time `json:"expires"`
+}
+
+// Target is the username or address the ban applies to.
+func (b *Ban) Target() string {
+	if b.IP != "" {
+		return b.IP
+	}
+	return b.Username
+}
+
+func (b *Ban) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
+
+// Store is a file-backed list of bans. It is safe for concurrent use.
+type Store struct {
+	path string
+	mu   sync.Mutex
+	bans []*Ban
+}
+
+// Open loads the store at path. A missing file is treated as an empty store
+// and created on the first change. An empty path keeps bans in memory only.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.bans); err != nil {
+		return nil, fmt.Errorf("bans: reading %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Add stores ban, replacing any earlier ban on the same target, and writes
+// the store to disk.
+func (s *Store) Add(ban Ban) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeLocked(ban.Target())
+	s.bans = append(s.bans, &ban)
+	return s.save()
+}
+
+// Remove lifts the ban on a username or address and reports whether there
+// was one.
+func (s *Store) Remove(target string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.removeLocked(target) {
+		return false, nil
+	}
+	return true, s.save()
+}
+
+// Find returns the ban that applies to username or ip, or nil if neither is
+// banned. Usernames are matched regardless of case.
+func (s *Store) Find(username, ip string) *Ban {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, b := range s.bans {
+		if b.expired(now) {
+			continue
+		}
+		if (b.IP != "" && b.IP == ip) || (b.Username != "" && strings.EqualFold(b.Username, username)) {
+			found := *b
+			return &found
+		}
+	}
+	return nil
+}
+
+// List returns the bans still in force, oldest first.
+func (s *Store) List() []Ban {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var list []Ban
+	for _, b := range s.bans {
+		if !b.expired(now) {
+			list = append(list, *b)
+		}
+	}
+	return list
+}
+
+// removeLocked must be called with mu held. Expired bans are dropped along
+// the way.
+func (s *Store) removeLocked(target string) bool {
+	now := time.Now()
+	found := false
+	kept := s.bans[:0]
+	for _, b := range s.bans {
+		if strings.EqualFold(b.Target(), target) {
+			found = true
+			continue
+		}
+		if !b.expired(now) {
+			kept = append(kept, b)
+		}
+	}
+	s.bans = kept
+	return found
+}
+
+// save writes the store atomically. It must be called with mu held.
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(s.path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,617 @@
+// Package client is a headless chat client. It speaks the same protocol as
+// the terminal UI and is meant for bots, tests and alternate front ends.
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cameroncuttingedge/terminal-chat/chat/protocol"
+)
+
+// EventType identifies the kind of Event delivered by a Client.
+type EventType int
+
+const (
+	EventMessage      EventType = iota // a chat message, see From, Color and Body
+	EventDirect                        // a private message, see From, To and Body
+	EventSystem                        // a server notice, see Body and, for alerts, Color
+	EventJoin                          // a user joined a room, see From, Color and Room
+	EventLeave                         // a user left a room, see From and Room
+	EventColor                         // the server assigned our color and room, see Color and Room
+	EventError                         // the server rejected a request, see Code and Body
+	EventDisconnected                  // the connection is gone, see Err; no more events follow
+	EventReconnecting                  // the connection dropped, see Err, Attempt and Delay
+	EventReconnected                   // the session was resumed, see Color and Room
+	EventRoster                        // everyone in Room, see Users; replaces the previous roster
+	EventPresence                      // a user's Status changed, see From, Status and Body
+	EventShutdown                      // the server is shutting down, see Body and Restart
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventMessage:
+		return "message"
+	case EventDirect:
+		return "direct"
+	case EventSystem:
+		return "system"
+	case EventJoin:
+		return "join"
+	case EventLeave:
+		return "leave"
+	case EventColor:
+		return "color"
+	case EventError:
+		return "error"
+	case EventDisconnected:
+		return "disconnected"
+	case EventReconnecting:
+		return "reconnecting"
+	case EventReconnected:
+		return "reconnected"
+	case EventRoster:
+		return "roster"
+	case EventPresence:
+		return "presence"
+	case EventShutdown:
+		return "shutdown"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+}
+
+// Event is something that happened on the connection.
+type Event struct {
+	Type  EventType
+	ID    string
+	From  string
+	To    string
+	Color string
+	Room  string
+	Body  string
+	Code  string
+	Time  time.Time
+	Err   error
+	// History is set on messages replayed from the server's log.
+	History bool
+	// Markup is set when Body may contain color and style tags the sender
+	// asked to have rendered. Otherwise Body is plain text.
+	Markup bool
+	// Attempt and Delay describe the next try of an EventReconnecting.
+	Attempt int
+	Delay   time.Duration
+	// Users is the room's roster in an EventRoster.
+	Users []User
+	// Status is the presence status in an EventPresence, one of
+	// protocol.StatusActive, StatusIdle or StatusAway.
+	Status string
+	// Restart is set on an EventShutdown when the server expects to be
+	// back shortly. A Client configured to reconnect then does so; otherwise
+	// an EventDisconnected with a *ShutdownError follows.
+	Restart bool
+}
+
+// User is an entry in a room's roster.
+type User struct {
+	Name   string
+	Color  string
+	Status string
+	// Away is the user's away message, if any.
+	Away string
+	// RTT is the user's heartbeat round trip as last measured by the server.
+	RTT time.Duration
+}
+
+// ServerError is returned when the server refuses a connection.
+type ServerError struct {
+	Code    string
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server error (%s): %s", e.Code, e.Message)
+}
+
+// ShutdownError is reported when the server shuts down.
+type ShutdownError struct {
+	Reason  string
+	Restart bool
+}
+
+func (e *ShutdownError) Error() string {
+	return "server shut down: " + e.Reason
+}
+
+var (
+	// ErrHeartbeatTimeout is reported when the server stops sending
+	// heartbeats.
+	ErrHeartbeatTimeout = errors.New("client: server heartbeat timed out")
+	// ErrNotConnected is returned by Send while the client is reconnecting.
+	ErrNotConnected = errors.New("client: not connected")
+	errClosed       = errors.New("client: closed")
+)
+
+// Config configures Dial.
+type Config struct {
+	Username string
+	// Password logs in to a registered account. Leave empty to join as a guest.
+	Password string
+	// HeartbeatTimeout is how long the server may stay silent before the
+	// connection is considered lost. Defaults to 30 seconds.
+	HeartbeatTimeout time.Duration
+	// DialTimeout bounds connecting and the handshake. Defaults to 10 seconds.
+	DialTimeout time.Duration
+
+	// Reconnect keeps the client alive when the connection drops. It redials
+	// with exponential backoff between ReconnectMin (default 1 second) and
+	// ReconnectMax (default 30 seconds) and resumes the session, so the
+	// server hands back the same color and replays missed messages.
+	Reconnect    bool
+	ReconnectMin time.Duration
+	ReconnectMax time.Duration
+
+	// TLS connects over TLS, authenticating the server by the fingerprint
+	// pinned in Pins rather than by a certificate authority.
+	TLS bool
+	// Pins remembers server fingerprints. When nil, pins only live as long
+	// as this Dial.
+	Pins *PinStore
+	// Repin replaces a pinned fingerprint that no longer matches instead of
+	// failing with a *FingerprintMismatchError. It only applies to Dial's own
+	// connection; a changed fingerprint when reconnecting is still an error.
+	Repin bool
+	// Fingerprint, when set, is the only certificate fingerprint the server
+	// may present, whatever Pins holds; Repin does not override it.
+	Fingerprint string
+	// OnNewPin is called when a server's fingerprint is pinned for the first
+	// time (or re-pinned) so the user can compare it with the server's.
+	OnNewPin func(addr, fingerprint string)
+	// OnPinError is called when a new pin could not be saved. The connection
+	// goes ahead, but the server will be trusted on first use again.
+	OnPinError func(addr string, err error)
+}
+
+// Client is a connection to a chat server.
+type Client struct {
+	cfg    Config
+	addr   string
+	events chan Event
+
+	mu      sync.Mutex
+	conn    net.Conn
+	enc     *protocol.Encoder // nil while disconnected
+	version int
+	color   string
+	room    string
+	token   string // resume token from the last welcome
+	lastID  string // ID of the last room message received
+	// commands the server lets us run, from the last welcome
+	commands []string
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Dial connects to the server at addr and logs in as cfg.Username. It returns
+// a *ServerError if the server refuses the login.
+func Dial(addr string, cfg Config) (*Client, error) {
+	if cfg.HeartbeatTimeout <= 0 {
+		cfg.HeartbeatTimeout = 30 * time.Second
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 10 * time.Second
+	}
+	if cfg.ReconnectMin <= 0 {
+		cfg.ReconnectMin = time.Second
+	}
+	if cfg.ReconnectMax < cfg.ReconnectMin {
+		cfg.ReconnectMax = 30 * time.Second
+	}
+
+	if cfg.TLS && cfg.Pins == nil {
+		cfg.Pins, _ = OpenPinStore("")
+	}
+
+	c := &Client{
+		cfg:    cfg,
+		addr:   addr,
+		events: make(chan Event, 128),
+		closed: make(chan struct{}),
+	}
+
+	dec, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	// The user asked to trust whatever this connection presented, not
+	// whatever the server presents later
+	c.cfg.Repin = false
+
+	// Hand the color over as a regular event so front ends can treat it like
+	// any other update.
+	c.events <- Event{Type: EventColor, Color: c.color, Room: c.room, Time: time.Now()}
+
+	go c.run(dec)
+	return c, nil
+}
+
+// connect dials the server and logs in, resuming the previous session if
+// there was one.
+func (c *Client) connect() (*protocol.Decoder, error) {
+	log.Printf("Attempting to connect to server at %s (tls=%v)", c.addr, c.cfg.TLS)
+	dialer := &net.Dialer{Timeout: c.cfg.DialTimeout}
+	var conn net.Conn
+	var err error
+	if c.cfg.TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, c.tlsConfig(c.addr))
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		var mismatch *FingerprintMismatchError
+		if errors.As(err, &mismatch) {
+			return nil, mismatch
+		}
+		return nil, err
+	}
+
+	enc := protocol.NewEncoder(conn)
+	dec := protocol.NewDecoder(conn)
+	if err := c.handshake(conn, enc, dec); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	c.enc = enc
+	c.mu.Unlock()
+
+	// Close may have run while we were dialing
+	select {
+	case <-c.closed:
+		conn.Close()
+		return nil, errClosed
+	default:
+	}
+
+	log.Printf("Connected as %s with protocol v%d", c.cfg.Username, c.version)
+	return dec, nil
+}
+
+func (c *Client) handshake(conn net.Conn, enc *protocol.Encoder, dec *protocol.Decoder) error {
+	conn.SetDeadline(time.Now().Add(c.cfg.DialTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	c.mu.Lock()
+	hello := protocol.New(protocol.TypeHello, "")
+	hello.Version = protocol.Version
+	hello.From = c.cfg.Username
+	hello.Password = c.cfg.Password
+	hello.Token = c.token
+	hello.LastID = c.lastID
+	c.mu.Unlock()
+	if err := enc.Encode(hello); err != nil {
+		return err
+	}
+
+	for {
+		var env protocol.Envelope
+		err := dec.Decode(&env)
+		if err == protocol.ErrMalformed {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		switch env.Type {
+		case protocol.TypeWelcome:
+			c.mu.Lock()
+			c.version = env.Version
+			c.color = env.Color
+			c.room = env.Room
+			c.token = env.Token
+			c.commands = env.Commands
+			c.mu.Unlock()
+			return nil
+		case protocol.TypeError:
+			return &ServerError{Code: env.Code, Message: env.Body}
+		}
+	}
+}
+
+// Username returns the name this client logged in with.
+func (c *Client) Username() string {
+	return c.cfg.Username
+}
+
+// Color returns the color the server assigned to this client.
+func (c *Client) Color() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.color
+}
+
+// Room returns the room this client is currently in.
+func (c *Client) Room() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.room
+}
+
+// Commands returns the commands the server announced that this client may
+// run, names and aliases alike.
+func (c *Client) Commands() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.commands...)
+}
+
+// SendDirect sends a private message to a single user. The server echoes it
+// back as an EventDirect once delivered.
+func (c *Client) SendDirect(to, text string) error {
+	return c.Send("/msg " + to + " " + text)
+}
+
+// Register claims the current username as an account protected by password.
+// The server answers with an EventSystem on success or an EventError.
+func (c *Client) Register(password string) error {
+	return c.Send("/register " + password)
+}
+
+// Join moves this client to another room.
+func (c *Client) Join(room string) error {
+	return c.Send("/join " + room)
+}
+
+// Events returns the channel on which incoming events are delivered. It is
+// closed after the EventDisconnected event. Callers must keep draining it
+// until then.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// Send posts a chat message. It returns ErrNotConnected while reconnecting.
+func (c *Client) Send(text string) error {
+	c.mu.Lock()
+	enc := c.enc
+	c.mu.Unlock()
+	if enc == nil {
+		return ErrNotConnected
+	}
+	return enc.Encode(protocol.New(protocol.TypeChat, text))
+}
+
+// Close hangs up. The Events channel is closed once the read loop exits.
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.mu.Lock()
+		if c.conn != nil {
+			err = c.conn.Close()
+		}
+		c.mu.Unlock()
+	})
+	return err
+}
+
+func (c *Client) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// run reads from the current connection and, if configured, reconnects
+// whenever it drops.
+func (c *Client) run(dec *protocol.Decoder) {
+	defer close(c.events)
+
+	for {
+		err := c.readLoop(dec)
+
+		c.mu.Lock()
+		c.enc = nil
+		c.conn.Close()
+		c.mu.Unlock()
+
+		if c.isClosed() {
+			// Closed on purpose, not worth reporting as an error
+			c.events <- Event{Type: EventDisconnected, Time: time.Now()}
+			return
+		}
+		if c.cfg.Reconnect && !isFatal(err) {
+			dec, err = c.reconnect(err)
+			if err == nil {
+				continue
+			}
+			if err == errClosed {
+				err = nil
+			}
+		}
+		c.Close()
+		c.events <- Event{Type: EventDisconnected, Err: err, Time: time.Now()}
+		return
+	}
+}
+
+// reconnect redials with exponential backoff until it succeeds, hits an
+// error that retrying cannot fix, or the client is closed.
+func (c *Client) reconnect(cause error) (*protocol.Decoder, error) {
+	delay := c.cfg.ReconnectMin
+	for attempt := 1; ; attempt++ {
+		c.events <- Event{Type: EventReconnecting, Err: cause, Attempt: attempt, Delay: delay, Time: time.Now()}
+
+		select {
+		case <-time.After(delay):
+		case <-c.closed:
+			return nil, errClosed
+		}
+
+		dec, err := c.connect()
+		if err == nil {
+			c.events <- Event{Type: EventReconnected, Color: c.Color(), Room: c.Room(), Time: time.Now()}
+			return dec, nil
+		}
+		if err == errClosed || isFatal(err) {
+			return nil, err
+		}
+		log.Printf("Reconnect attempt %d failed: %v", attempt, err)
+		cause = err
+
+		delay *= 2
+		if delay > c.cfg.ReconnectMax {
+			delay = c.cfg.ReconnectMax
+		}
+	}
+}
+
+// isFatal reports whether a connect error will not go away by retrying.
+// A taken username is worth retrying: it is usually our own stale connection
+// that the server has not noticed is gone yet. So is being turned away for
+// connecting too often, and a shutdown the server said it would come back
+// from.
+func isFatal(err error) bool {
+	var mismatch *FingerprintMismatchError
+	if errors.As(err, &mismatch) {
+		return true
+	}
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) {
+		return serverErr.Code != protocol.CodeUsernameTaken && serverErr.Code != protocol.CodeRateLimited
+	}
+	var shutdown *ShutdownError
+	if errors.As(err, &shutdown) {
+		return !shutdown.Restart
+	}
+	return false
+}
+
+// pong answers a server ping so the server knows this client is alive.
+func (c *Client) pong(id string) {
+	c.mu.Lock()
+	enc := c.enc
+	c.mu.Unlock()
+	if enc == nil {
+		return
+	}
+	pong := &protocol.Envelope{Type: protocol.TypePong, ID: id, Time: time.Now().UTC()}
+	if err := enc.Encode(pong); err != nil {
+		log.Printf("Error answering ping: %v", err)
+	}
+}
+
+func (c *Client) readLoop(dec *protocol.Decoder) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	for {
+		// Any frame, heartbeats included, proves the server is still there
+		conn.SetReadDeadline(time.Now().Add(c.cfg.HeartbeatTimeout))
+
+		var env protocol.Envelope
+		err := dec.Decode(&env)
+		if err == protocol.ErrMalformed {
+			log.Println("Ignoring malformed frame from server")
+			continue
+		}
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				err = ErrHeartbeatTimeout
+			}
+			log.Printf("Error reading from server: %v", err)
+			return err
+		}
+
+		log.Printf("Received %s frame from server: %s", env.Type, env.Body)
+
+		ev := Event{
+			ID:      env.ID,
+			From:    env.From,
+			To:      env.To,
+			Color:   env.Color,
+			Room:    env.Room,
+			Body:    env.Body,
+			Code:    env.Code,
+			Time:    env.Time,
+			History: env.History,
+			Markup:  env.Markup,
+		}
+		switch env.Type {
+		case protocol.TypePing:
+			c.pong(env.ID)
+			continue
+		case protocol.TypeChat:
+			// Remember where we are so a resumed session can replay the rest
+			c.mu.Lock()
+			c.lastID = env.ID
+			c.mu.Unlock()
+			ev.Type = EventMessage
+		case protocol.TypeDirect:
+			ev.Type = EventDirect
+		case protocol.TypeSystem:
+			ev.Type = EventSystem
+		case protocol.TypeJoin:
+			if env.From == c.cfg.Username {
+				// Our own join is how the server confirms a room change
+				c.mu.Lock()
+				c.room = env.Room
+				c.mu.Unlock()
+			}
+			ev.Type = EventJoin
+		case protocol.TypeLeave:
+			ev.Type = EventLeave
+		case protocol.TypeWelcome:
+			c.mu.Lock()
+			c.color = env.Color
+			c.room = env.Room
+			if env.Commands != nil {
+				c.commands = env.Commands
+			}
+			c.mu.Unlock()
+			ev.Type = EventColor
+		case protocol.TypeError:
+			if env.Code == protocol.CodeKicked || env.Code == protocol.CodeBanned {
+				// The server is about to hang up and we must not come back
+				return &ServerError{Code: env.Code, Message: env.Body}
+			}
+			ev.Type = EventError
+		case protocol.TypeShutdown:
+			ev.Type = EventShutdown
+			ev.Restart = env.Restart
+			c.events <- ev
+			return &ShutdownError{Reason: env.Body, Restart: env.Restart}
+		case protocol.TypeRoster:
+			ev.Type = EventRoster
+			ev.Users = make([]User, 0, len(env.Users))
+			for _, u := range env.Users {
+				ev.Users = append(ev.Users, User{
+					Name:   u.Name,
+					Color:  u.Color,
+					Status: u.Status,
+					Away:   u.Away,
+					RTT:    time.Duration(u.RTT) * time.Millisecond,
+				})
+			}
+		case protocol.TypePresence:
+			ev.Type = EventPresence
+			ev.Status = env.Status
+		default:
+			// Newer servers may send kinds this client does not know yet
+			log.Printf("Ignoring unknown frame type %q", env.Type)
+			continue
+		}
+		c.events <- ev
+	}
+}
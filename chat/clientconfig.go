@@ -0,0 +1,174 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// clientSettings is the client's config file: preferences, named after the
+// flags they stand in for, and saved server profiles. Flags given on the
+// command line win over the file.
+type clientSettings struct {
+	// Profile is used when -profile is not given.
+	Profile     string   `json:"profile,omitempty"`
+	Sound       *bool    `json:"sound,omitempty"`
+	Notify      *bool    `json:"notify,omitempty"`
+	Keywords    []string `json:"keywords,omitempty"`
+	CompleteKey string   `json:"complete-key,omitempty"`
+	TimeFormat  string   `json:"time-format,omitempty"`
+
+	Profiles map[string]*profile `json:"profiles,omitempty"`
+}
+
+// profile is a saved server to connect to.
+type profile struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port,omitempty"`
+	Username string `json:"username,omitempty"`
+	TLS      bool   `json:"tls,omitempty"`
+	// Fingerprint pins the server's certificate, overriding
+	// known_servers.json.
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// Room is joined after connecting.
+	Room string `json:"room,omitempty"`
+}
+
+// defaultClientConfigPath returns where the client's config file lives.
+func defaultClientConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "terminal-chat", "config.json"), nil
+}
+
+// loadClientSettings reads the config file at path. A missing file, or an
+// empty path, is an empty config.
+func loadClientSettings(path string) (*clientSettings, error) {
+	settings := &clientSettings{Profiles: make(map[string]*profile)}
+	if path == "" {
+		return settings, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return settings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+	if settings.Profiles == nil {
+		settings.Profiles = make(map[string]*profile)
+	}
+	for name, p := range settings.Profiles {
+		if p == nil || p.Host == "" {
+			return nil, fmt.Errorf("reading %s: profile %q needs a host", path, name)
+		}
+	}
+	return settings, nil
+}
+
+func (s *clientSettings) save(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0600)
+}
+
+// profileNames lists the saved profiles in alphabetical order.
+func (s *clientSettings) profileNames() []string {
+	names := make([]string, 0, len(s.Profiles))
+	for name := range s.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyPreferences copies the file's preferences to the flags that were not
+// set on the command line, as listed in set.
+func (s *clientSettings) applyPreferences(set map[string]bool, keywords, completeKey, timeFormat *string) {
+	if s.Sound != nil && !set["sound"] {
+		playSound = *s.Sound
+	}
+	if s.Notify != nil && !set["notify"] {
+		showNotifications = *s.Notify
+	}
+	if len(s.Keywords) > 0 && !set["keywords"] {
+		*keywords = strings.Join(s.Keywords, ",")
+	}
+	if s.CompleteKey != "" && !set["complete-key"] {
+		*completeKey = s.CompleteKey
+	}
+	if s.TimeFormat != "" && !set["time-format"] {
+		*timeFormat = s.TimeFormat
+	}
+}
+
+// endpoint is where to connect and whether over TLS.
+type endpoint struct {
+	host string
+	port string
+	tls  bool
+}
+
+func (e endpoint) addr() string {
+	return net.JoinHostPort(e.host, e.port)
+}
+
+func (e endpoint) String() string {
+	if e.tls {
+		return e.addr() + " (TLS)"
+	}
+	return e.addr()
+}
+
+// withProfile returns e with the values from p filled in, except those
+// given as flags, listed in set. A nil p changes nothing.
+func (e endpoint) withProfile(p *profile, set map[string]bool) endpoint {
+	if p == nil {
+		return e
+	}
+	if !set["ip"] {
+		e.host = p.Host
+	}
+	if !set["port"] && p.Port != 0 {
+		e.port = strconv.Itoa(p.Port)
+	}
+	if !set["tls"] {
+		e.tls = p.TLS
+	}
+	return e
+}
+
+// saveProfile saves connecting to e as username as profile name, keeping the
+// fingerprint and room of an existing profile by that name.
+func (s *clientSettings) saveProfile(path, name string, e endpoint, username string) error {
+	port, err := strconv.Atoi(e.port)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", e.port)
+	}
+	p := &profile{Host: e.host, Port: port, Username: username, TLS: e.tls}
+	if old := s.Profiles[name]; old != nil {
+		p.Fingerprint = old.Fingerprint
+		p.Room = old.Room
+	}
+	s.Profiles[name] = p
+	return s.save(path)
+}
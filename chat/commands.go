@@ -0,0 +1,223 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/cameroncuttingedge/terminal-chat/chat/protocol"
+	"github.com/cameroncuttingedge/terminal-chat/util"
+)
+
+// permission is what a user needs to be allowed to run a command.
+type permission int
+
+const (
+	permEveryone permission = iota
+	permOperator
+)
+
+// command is a slash command users can run. Arguments are separated by
+// whitespace; when rest is set the last argument takes the remainder of the
+// line, spaces included. The arguments of secret commands are kept out of the
+// logs.
+type command struct {
+	name    string
+	aliases []string
+	usage   string
+	help    string
+	minArgs int
+	maxArgs int
+	rest    bool
+	secret  bool
+	perm    permission
+	run     func(s *Server, c *client, args []string)
+}
+
+// commandRegistry looks commands up by name or alias and keeps them in the
+// order they were registered for /help.
+type commandRegistry struct {
+	list   []*command
+	byName map[string]*command
+}
+
+func newCommandRegistry() *commandRegistry {
+	r := &commandRegistry{byName: make(map[string]*command)}
+	r.register(&command{name: "/help", usage: "/help [command]", help: "List commands or show how to use one", maxArgs: 1, run: cmdHelp})
+	r.register(&command{name: "/join", usage: "/join <room>", help: "Move to another room", minArgs: 1, maxArgs: 1, run: cmdJoin})
+	r.register(&command{name: "/part", usage: "/part", help: "Go back to #" + DefaultRoom, run: cmdPart})
+	r.register(&command{name: "/rooms", usage: "/rooms", help: "List rooms and how many people are in them", run: cmdRooms})
+	r.register(&command{name: "/who", usage: "/who", help: "List who is in this room", run: cmdWho})
+	r.register(&command{name: "/away", usage: "/away [message]", help: "Tell others you are away", maxArgs: 1, rest: true, run: cmdAway})
+	r.register(&command{name: "/back", usage: "/back", help: "Tell others you are back", run: cmdBack})
+	r.register(&command{name: "/msg", usage: "/msg <user> <text>", help: "Send a private message", minArgs: 2, maxArgs: 2, rest: true, run: cmdMsg})
+	r.register(&command{name: "/register", usage: "/register <password>", help: "Protect your username with a password", minArgs: 1, maxArgs: 1, secret: true, run: cmdRegister})
+	r.register(&command{name: "/markup", usage: "/markup [on|off]", help: "Have color and style tags in your messages rendered", maxArgs: 1, run: cmdMarkup})
+	r.register(&command{name: "/kick", usage: "/kick <user> [reason]", help: "Disconnect someone", minArgs: 1, maxArgs: 2, rest: true, perm: permOperator, run: cmdKick})
+	r.register(&command{name: "/ban", usage: "/ban <user|ip> [duration] [reason]", help: "Keep a user or address out, for good or e.g. for 2h or 7d", minArgs: 1, maxArgs: 3, rest: true, perm: permOperator, run: cmdBan})
+	r.register(&command{name: "/unban", usage: "/unban <user|ip>", help: "Lift a ban", minArgs: 1, maxArgs: 1, perm: permOperator, run: cmdUnban})
+	r.register(&command{name: "/bans", usage: "/bans", help: "List bans", perm: permOperator, run: cmdBans})
+	r.register(&command{name: "/mute", usage: "/mute <user> [duration]", help: "Stop someone from talking", minArgs: 1, maxArgs: 2, perm: permOperator, run: cmdMute})
+	r.register(&command{name: "/unmute", usage: "/unmute <user>", help: "Let someone talk again", minArgs: 1, maxArgs: 1, perm: permOperator, run: cmdUnmute})
+	r.register(&command{name: "/slowmode", usage: "/slowmode <seconds>", help: "Limit how often people may speak in this room, 0 for no limit", minArgs: 1, maxArgs: 1, perm: permOperator, run: cmdSlowMode})
+	r.register(&command{name: "/stats", usage: "/stats", help: "Show server counters, flood protection included", perm: permOperator, run: cmdStats})
+	r.register(&command{name: "/man", aliases: []string{"!man"}, usage: "/man", help: "How to use the chat window", run: cmdMan})
+	r.register(&command{name: "/party", aliases: []string{"!party"}, usage: "/party", help: "Celebrate", run: cmdParty})
+	return r
+}
+
+func (r *commandRegistry) register(cmd *command) {
+	r.list = append(r.list, cmd)
+	r.byName[cmd.name] = cmd
+	for _, alias := range cmd.aliases {
+		r.byName[alias] = cmd
+	}
+}
+
+func (r *commandRegistry) lookup(name string) *command {
+	return r.byName[strings.ToLower(name)]
+}
+
+// names lists every name and alias c is allowed to use, for completion.
+func (r *commandRegistry) names(s *Server, c *client) []string {
+	var names []string
+	for _, cmd := range r.list {
+		if !s.allowed(c, cmd.perm) {
+			continue
+		}
+		names = append(names, cmd.name)
+		names = append(names, cmd.aliases...)
+	}
+	return names
+}
+
+// runCommand runs message as a command if it is one and reports whether it
+// was. Unknown /commands are answered with an error rather than broadcast;
+// text starting with '!' is only a command if it names one, so "!!!" can
+// still be said out loud.
+func (s *Server) runCommand(c *client, message string) bool {
+	if !strings.HasPrefix(message, "/") && !strings.HasPrefix(message, "!") {
+		return false
+	}
+	name, line := splitCommand(message)
+	cmd := s.commands.lookup(name)
+	if cmd == nil {
+		if strings.HasPrefix(message, "!") {
+			return false
+		}
+		c.sendError(protocol.CodeUnknownCommand, fmt.Sprintf("Unknown command %s. Type /help for a list.", name))
+		return true
+	}
+	if !s.allowed(c, cmd.perm) {
+		c.sendError(protocol.CodePermissionDenied, fmt.Sprintf("You are not allowed to use %s.", cmd.name))
+		return true
+	}
+
+	var args []string
+	if cmd.rest {
+		args = splitArgs(line, cmd.maxArgs)
+	} else {
+		args = strings.Fields(line)
+	}
+	if len(args) < cmd.minArgs || len(args) > cmd.maxArgs {
+		c.sendError(protocol.CodeBadRequest, "Usage: "+cmd.usage)
+		return true
+	}
+	cmd.run(s, c, args)
+	return true
+}
+
+// allowed reports whether c holds perm.
+func (s *Server) allowed(c *client, perm permission) bool {
+	switch perm {
+	case permOperator:
+		return c.operator
+	default:
+		return true
+	}
+}
+
+// splitCommand separates the command name from the rest of the line.
+func splitCommand(message string) (name, line string) {
+	i := strings.IndexFunc(message, unicode.IsSpace)
+	if i < 0 {
+		return message, ""
+	}
+	return message[:i], strings.TrimSpace(message[i:])
+}
+
+// splitArgs splits line into at most n whitespace separated arguments, the
+// last of which holds whatever is left.
+func splitArgs(line string, n int) []string {
+	var args []string
+	for line != "" && n > 0 {
+		if len(args) == n-1 {
+			args = append(args, line)
+			break
+		}
+		i := strings.IndexFunc(line, unicode.IsSpace)
+		if i < 0 {
+			args = append(args, line)
+			break
+		}
+		args = append(args, line[:i])
+		line = strings.TrimLeftFunc(line[i:], unicode.IsSpace)
+	}
+	return args
+}
+
+func cmdHelp(s *Server, c *client, args []string) {
+	if len(args) == 1 {
+		name := args[0]
+		if !strings.HasPrefix(name, "/") && !strings.HasPrefix(name, "!") {
+			name = "/" + name
+		}
+		cmd := s.commands.lookup(name)
+		if cmd == nil || !s.allowed(c, cmd.perm) {
+			c.sendError(protocol.CodeUnknownCommand, fmt.Sprintf("Unknown command %s. Type /help for a list.", name))
+			return
+		}
+		text := fmt.Sprintf("%s\n  %s", cmd.usage, cmd.help)
+		if len(cmd.aliases) > 0 {
+			text += "\n  Also: " + strings.Join(cmd.aliases, ", ")
+		}
+		c.enqueue(protocol.New(protocol.TypeSystem, text))
+		return
+	}
+
+	lines := []string{"Commands:"}
+	for _, cmd := range s.commands.list {
+		if !s.allowed(c, cmd.perm) {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("  %s - %s", cmd.usage, cmd.help))
+	}
+	c.enqueue(protocol.New(protocol.TypeSystem, strings.Join(lines, "\n")))
+}
+
+func cmdMan(s *Server, c *client, args []string) {
+	c.enqueue(protocol.New(protocol.TypeSystem, util.GetSpecialMessage("man")))
+}
+
+func cmdParty(s *Server, c *client, args []string) {
+	c.enqueue(protocol.New(protocol.TypeSystem, util.GetSpecialMessage("party")))
+}
+
+func cmdMarkup(s *Server, c *client, args []string) {
+	switch {
+	case len(args) == 0:
+		c.markup = !c.markup
+	case args[0] == "on":
+		c.markup = true
+	case args[0] == "off":
+		c.markup = false
+	default:
+		c.sendError(protocol.CodeBadRequest, "Usage: /markup [on|off]")
+		return
+	}
+	if c.markup {
+		c.enqueue(protocol.New(protocol.TypeSystem, "Markup is on. Color and style tags in your messages will be rendered."))
+	} else {
+		c.enqueue(protocol.New(protocol.TypeSystem, "Markup is off. Your messages are shown exactly as typed."))
+	}
+}
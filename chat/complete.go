@@ -0,0 +1,149 @@
+package chat
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	chatclient "github.com/cameroncuttingedge/terminal-chat/chat/client"
+	"github.com/gdamore/tcell/v2"
+)
+
+// maxCompletionHint is how many candidates the input title shows at once.
+const maxCompletionHint = 6
+
+// completion is an ongoing tab-completion in the input field. Pressing the
+// completion key again moves on to the next candidate.
+type completion struct {
+	base       string // text before the word being completed
+	candidates []string
+	index      int
+	suffix     string // appended after the candidate
+}
+
+func (c *completion) text() string {
+	return c.base + c.candidates[c.index] + c.suffix
+}
+
+// parseKey looks a key up by its tcell name, such as "Tab" or "Ctrl-Space".
+func parseKey(name string) (tcell.Key, error) {
+	for key, keyName := range tcell.KeyNames {
+		if strings.EqualFold(keyName, name) {
+			return key, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown key %q", name)
+}
+
+// handleCompletion completes usernames from the roster and the commands the
+// server announced when the completion key is pressed in the input. It
+// reports whether it used up the event.
+func (ui *ChatUI) handleCompletion(c *chatclient.Client, event *tcell.EventKey) bool {
+	switch {
+	case event.Key() == ui.completeKey:
+		ui.complete(c, true)
+		return true
+	case ui.completeKey == tcell.KeyTab && event.Key() == tcell.KeyBacktab:
+		ui.complete(c, false)
+		return true
+	}
+	ui.endCompletion()
+	return false
+}
+
+// complete starts a completion for the word before the cursor or moves to the
+// next (or previous) candidate. It runs on the UI goroutine.
+func (ui *ChatUI) complete(c *chatclient.Client, forward bool) {
+	text := ui.Input.GetText()
+	if ui.completion != nil && text == ui.completion.text() {
+		n := len(ui.completion.candidates)
+		if forward {
+			ui.completion.index = (ui.completion.index + 1) % n
+		} else {
+			ui.completion.index = (ui.completion.index + n - 1) % n
+		}
+	} else {
+		ui.completion = ui.newCompletion(c, text)
+		if ui.completion == nil {
+			return
+		}
+	}
+
+	ui.Input.SetText(ui.completion.text(), true)
+	if len(ui.completion.candidates) == 1 {
+		// Nothing to cycle through
+		ui.endCompletion()
+		return
+	}
+	ui.showCompletionHint()
+}
+
+// newCompletion finds the candidates for the last word of text, or returns
+// nil if there are none. A leading word starting with '/' or '!' completes
+// command names; any other word completes usernames in the room.
+func (ui *ChatUI) newCompletion(c *chatclient.Client, text string) *completion {
+	i := strings.LastIndexAny(text, " \t\n")
+	base, word := text[:i+1], text[i+1:]
+	if word == "" {
+		return nil
+	}
+
+	comp := &completion{base: base, suffix: " "}
+	if base == "" && (strings.HasPrefix(word, "/") || strings.HasPrefix(word, "!")) {
+		for _, name := range append(c.Commands(), localCommands...) {
+			if strings.HasPrefix(name, word) {
+				comp.candidates = append(comp.candidates, name)
+			}
+		}
+	} else {
+		at := ""
+		if strings.HasPrefix(word, "@") {
+			at, word = "@", word[1:]
+		}
+		for name := range ui.users {
+			if strings.HasPrefix(strings.ToLower(name), strings.ToLower(word)) {
+				comp.candidates = append(comp.candidates, at+name)
+			}
+		}
+		if base == "" && at == "" {
+			// Addressing someone at the start of a line
+			comp.suffix = ": "
+		}
+	}
+	if len(comp.candidates) == 0 {
+		return nil
+	}
+	sort.Strings(comp.candidates)
+	return comp
+}
+
+// showCompletionHint lists the candidates in the input's title with the
+// current one highlighted.
+func (ui *ChatUI) showCompletionHint() {
+	comp := ui.completion
+	start := 0
+	if comp.index >= maxCompletionHint {
+		start = comp.index - maxCompletionHint + 1
+	}
+	var hint []string
+	for i := start; i < len(comp.candidates) && i < start+maxCompletionHint; i++ {
+		name := plainText(comp.candidates[i])
+		if i == comp.index {
+			name = "[::r]" + name + "[::-]"
+		}
+		hint = append(hint, name)
+	}
+	if start+maxCompletionHint < len(comp.candidates) {
+		hint = append(hint, "…")
+	}
+	ui.Input.SetTitle(fmt.Sprintf("%s─ %s ", ui.inputTitle, strings.Join(hint, " ")))
+}
+
+// endCompletion forgets the current completion and restores the title.
+func (ui *ChatUI) endCompletion() {
+	if ui.completion == nil {
+		return
+	}
+	ui.completion = nil
+	ui.Input.SetTitle(ui.inputTitle)
+}
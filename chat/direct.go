@@ -0,0 +1,50 @@
+package chat
+
+import (
+	"fmt"
+
+	"github.com/cameroncuttingedge/terminal-chat/chat/protocol"
+)
+
+// findClient returns the connected client with the given username, or nil.
+func (s *Server) findClient(username string) *client {
+	s.clientMux.Lock()
+	defer s.clientMux.Unlock()
+
+	key := usernameKey(username)
+	if !s.usernameSet[key] {
+		return nil
+	}
+	for _, c := range s.clients {
+		if usernameKey(c.username) == key {
+			return c
+		}
+	}
+	return nil
+}
+
+// cmdMsg runs /msg <user> <text>.
+func cmdMsg(s *Server, sender *client, args []string) {
+	recipient := s.findClient(args[0])
+	if recipient == nil {
+		sender.sendError(protocol.CodeUserOffline, fmt.Sprintf("%s is not online.", args[0]))
+		return
+	}
+
+	if s.rejectIfMuted(sender) {
+		return
+	}
+
+	msg := protocol.New(protocol.TypeDirect, args[1])
+	msg.From = sender.username
+	msg.Color = sender.color
+	msg.To = recipient.username
+	msg.Markup = sender.markup
+
+	s.logger.Printf("[Server] Direct message %s from '%s' to '%s'", msg.ID, msg.From, msg.To)
+	recipient.enqueue(msg)
+	if recipient != sender {
+		// Echo back so the sender sees what was delivered
+		sender.enqueue(msg)
+	}
+}
@@ -0,0 +1,97 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/cameroncuttingedge/terminal-chat/chat/discovery"
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// discoveryInterval is how often the discovery screen asks for servers.
+const discoveryInterval = 2 * time.Second
+
+// showDiscoveryScreen lists the servers answering on the local network,
+// keeping the list up to date while it is shown, and returns the one picked.
+// fallback, the server the flags point at, is offered too. ok is false if the
+// user quit instead.
+func showDiscoveryScreen(app *tview.Application, port int, fallback endpoint) (picked endpoint, ok bool) {
+	pick := func(e endpoint) func() {
+		return func() {
+			picked, ok = e, true
+			app.Stop()
+		}
+	}
+
+	list := tview.NewList().
+		SetSecondaryTextColor(tcell.ColorGray).
+		SetSelectedFocusOnly(false).
+		AddItem("Connect to "+fallback.String(), "Not listed? Start the client with -ip=<address>", 0, pick(fallback)).
+		SetDoneFunc(func() {
+			app.Stop()
+		})
+	list.SetBackgroundColor(tcell.ColorDefault)
+	status := tview.NewTextView().
+		SetDynamicColors(true).
+		SetText("[gray]Looking for servers... Enter connects, Esc quits.[-]")
+	status.SetBackgroundColor(tcell.ColorDefault)
+
+	layout := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(list, 0, 1, true).
+		AddItem(status, 1, 0, false)
+	layout.SetBorder(true).SetTitle("Servers on your network").SetTitleAlign(tview.AlignLeft).SetBackgroundColor(tcell.ColorDefault)
+
+	// Servers already listed, by announcement ID, with their list index.
+	// Only touched on the UI goroutine.
+	listed := make(map[string]int)
+	found := func(a discovery.Announcement) {
+		main, secondary := describeServer(a)
+		if index, ok := listed[a.ID]; ok {
+			list.SetItemText(index, main, secondary)
+			return
+		}
+		index := list.GetItemCount() - 1 // just above the fallback
+		list.InsertItem(index, main, secondary, 0, pick(endpoint{host: a.Host, port: strconv.Itoa(a.Port), tls: a.TLS}))
+		if len(listed) == 0 {
+			list.SetCurrentItem(0)
+		}
+		listed[a.ID] = index
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		err := discovery.Browse(ctx, port, discoveryInterval, func(a discovery.Announcement) {
+			if ctx.Err() == nil {
+				app.QueueUpdateDraw(func() { found(a) })
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			app.QueueUpdateDraw(func() {
+				status.SetText(fmt.Sprintf("[red]Cannot look for servers: %s[-]", tview.Escape(err.Error())))
+			})
+		}
+	}()
+
+	if err := app.SetRoot(layout, true).SetFocus(list).Run(); err != nil {
+		return endpoint{}, false
+	}
+	return picked, ok
+}
+
+// describeServer renders a server for the discovery list.
+func describeServer(a discovery.Announcement) (main, secondary string) {
+	users := fmt.Sprintf("%d users", a.Users)
+	if a.Users == 1 {
+		users = "1 user"
+	}
+	secondary = fmt.Sprintf("%s, %s online", net.JoinHostPort(a.Host, strconv.Itoa(a.Port)), users)
+	if a.TLS {
+		secondary += ", TLS"
+	}
+	return tview.Escape(a.Name), secondary
+}
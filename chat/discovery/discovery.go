@@ -0,0 +1,194 @@
+// Package discovery lets clients find chat servers on the local network
+// without knowing their address. Clients broadcast a query over UDP and every
+// server listening for queries answers with an Announcement. Queries are
+// repeated, so servers that start later, and changing user counts, show up.
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+)
+
+// Port is the UDP port servers listen on for queries by default.
+const Port = 9999
+
+// service marks our packets so unrelated traffic on the port is ignored.
+const service = "terminal-chat"
+
+const (
+	typeQuery    = "query"
+	typeAnnounce = "announce"
+)
+
+// maxPacket is the largest packet read; announcements are far smaller.
+const maxPacket = 2048
+
+// Announcement describes a server, as sent in answer to a query.
+type Announcement struct {
+	// ID is random for every run of a server, so one reached on several
+	// addresses can be listed once.
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Port  int    `json:"port"`
+	Users int    `json:"users"`
+	TLS   bool   `json:"tls,omitempty"`
+	// Host is the address the announcement came from. It is filled in by
+	// Browse, not sent.
+	Host string `json:"-"`
+}
+
+type packet struct {
+	Service string `json:"service"`
+	Type    string `json:"type"`
+	*Announcement
+}
+
+// Responder answers discovery queries for a server.
+type Responder struct {
+	conn *net.UDPConn
+}
+
+// Listen starts listening for queries on UDP port on all interfaces.
+func Listen(port int) (*Responder, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+	return &Responder{conn: conn}, nil
+}
+
+// Serve answers queries with what announce returns until Close is called.
+// Queries are left unanswered while announce reports false, such as when the
+// server cannot be reached from the network. Only queries from loopback,
+// private and link-local addresses are answered, so the server cannot be used
+// to bounce traffic at the internet.
+func (r *Responder) Serve(announce func() (Announcement, bool)) error {
+	buf := make([]byte, maxPacket)
+	for {
+		n, from, err := r.conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !from.IP.IsLoopback() && !from.IP.IsPrivate() && !from.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		var query packet
+		if json.Unmarshal(buf[:n], &query) != nil || query.Service != service || query.Type != typeQuery {
+			continue
+		}
+		a, ok := announce()
+		if !ok {
+			continue
+		}
+		reply, err := json.Marshal(packet{Service: service, Type: typeAnnounce, Announcement: &a})
+		if err != nil {
+			return err
+		}
+		r.conn.WriteToUDP(reply, from)
+	}
+}
+
+// Close stops Serve.
+func (r *Responder) Close() error {
+	return r.conn.Close()
+}
+
+// Browse broadcasts a query to UDP port every interval and calls found for
+// every answer until ctx is done. found is called once per answer, so the
+// same server is reported again on every round.
+func Browse(ctx context.Context, port int, interval time.Duration, found func(Announcement)) error {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		query, _ := json.Marshal(packet{Service: service, Type: typeQuery})
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			for _, addr := range broadcastAddrs(port) {
+				conn.WriteToUDP(query, addr)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				// Unblock the read below
+				conn.Close()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, maxPacket)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		var answer packet
+		if json.Unmarshal(buf[:n], &answer) != nil || answer.Service != service || answer.Type != typeAnnounce || answer.Announcement == nil {
+			continue
+		}
+		a := *answer.Announcement
+		a.Host = from.IP.String()
+		found(a)
+	}
+}
+
+// broadcastAddrs lists where to send queries: the broadcast address of every
+// IPv4 network we are on, the limited broadcast address and loopback, as
+// broadcasts do not reach servers on this machine everywhere.
+func broadcastAddrs(port int) []*net.UDPAddr {
+	addrs := []*net.UDPAddr{
+		{IP: net.IPv4bcast, Port: port},
+		{IP: net.IPv4(127, 0, 0, 1), Port: port},
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return addrs
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagBroadcast == 0 {
+			continue
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range ifaceAddrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil {
+				continue
+			}
+			ip := ipnet.IP.To4()
+			mask := ipnet.Mask
+			if len(mask) == net.IPv6len {
+				mask = mask[12:]
+			}
+			if len(mask) != net.IPv4len {
+				continue
+			}
+			bcast := make(net.IP, len(ip))
+			for i := range ip {
+				bcast[i] = ip[i] | ^mask[i]
+			}
+			addrs = append(addrs, &net.UDPAddr{IP: bcast, Port: port})
+		}
+	}
+	return addrs
+}
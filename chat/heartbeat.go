@@ -0,0 +1,77 @@
+package chat
+
+import (
+	"time"
+
+	"github.com/cameroncuttingedge/terminal-chat/chat/protocol"
+)
+
+// pongVersion is the first protocol version whose clients answer pings.
+// Older clients are never evicted for being quiet.
+const pongVersion = 2
+
+func (s *Server) startHeartbeat() {
+	interval := s.config().HeartbeatInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.sendHeartbeat()
+			s.checkIdle()
+			s.expireSessions()
+			s.expireAddressLimits()
+			// Pick up a new interval from Reload
+			if next := s.config().HeartbeatInterval; next != interval {
+				interval = next
+				ticker.Reset(interval)
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// sendHeartbeat pings every client and disconnects those that have been
+// silent for longer than ClientTimeout. Closing the connection ends the
+// client's read loop, which removes it through the usual removing path.
+func (s *Server) sendHeartbeat() {
+	ping := protocol.New(protocol.TypePing, "")
+	now := time.Now()
+	timeout := s.config().ClientTimeout
+
+	s.clientMux.Lock()
+	defer s.clientMux.Unlock()
+
+	for _, c := range s.clients {
+		if c.version >= pongVersion && now.Sub(c.lastSeen) > timeout {
+			s.logger.Printf("[Server] No answer from '%s' for %s, disconnecting", c.username, now.Sub(c.lastSeen).Round(time.Second))
+			c.close()
+			continue
+		}
+		c.pingID = ping.ID
+		c.pingSent = now
+		c.enqueue(ping)
+	}
+}
+
+// markSeen records that a frame just arrived from c.
+func (s *Server) markSeen(c *client) {
+	s.clientMux.Lock()
+	c.lastSeen = time.Now()
+	s.clientMux.Unlock()
+}
+
+// recordPong measures the round trip of the ping that id answers. Answers to
+// older pings are ignored.
+func (s *Server) recordPong(c *client, id string) {
+	s.clientMux.Lock()
+	defer s.clientMux.Unlock()
+
+	if id == "" || id != c.pingID {
+		return
+	}
+	c.rtt = time.Since(c.pingSent)
+	c.pingID = ""
+}
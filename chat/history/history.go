@@ -0,0 +1,257 @@
+// Package history keeps an append-only on-disk log of chat messages so the
+// server can replay recent conversation to clients that join later.
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cameroncuttingedge/terminal-chat/chat/protocol"
+)
+
+// Options bounds how much history is kept. Zero values mean no limit.
+type Options struct {
+	// MaxMessages is how many messages are retained across all rooms.
+	MaxMessages int
+	// MaxAge is how long a message is retained.
+	MaxAge time.Duration
+}
+
+// Log is an append-only message log. It is safe for concurrent use.
+type Log struct {
+	path string
+	opts Options
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	entries []*protocol.Envelope
+	// lines counts entries in the file, which may include ones already
+	// trimmed from memory until the next compaction, and oldest is when the
+	// first of them was logged.
+	lines  int
+	oldest time.Time
+}
+
+// Open loads the log at path, applies retention and opens it for appending.
+func Open(path string, opts Options) (*Log, error) {
+	l := &Log{path: path, opts: opts}
+
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	if err := l.compact(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) load() error {
+	f, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := protocol.NewDecoder(f)
+	for {
+		var env protocol.Envelope
+		err := dec.Decode(&env)
+		if err == protocol.ErrMalformed {
+			// A torn final write from a crash; skip it
+			continue
+		}
+		if err != nil {
+			break
+		}
+		e := env
+		l.entries = append(l.entries, &e)
+	}
+	l.trim(time.Now())
+	return nil
+}
+
+// trim drops entries beyond the retention limits. It must be called with mu
+// held (or before the log is shared).
+func (l *Log) trim(now time.Time) {
+	start := 0
+	cutoff := l.cutoff(now)
+	for start < len(l.entries) && l.entries[start].Time.Before(cutoff) {
+		start++
+	}
+	if l.opts.MaxMessages > 0 && len(l.entries)-start > l.opts.MaxMessages {
+		start = len(l.entries) - l.opts.MaxMessages
+	}
+	if start > 0 {
+		l.entries = append([]*protocol.Envelope(nil), l.entries[start:]...)
+	}
+}
+
+// cutoff returns the time before which messages are no longer retained, or
+// the zero time if they are kept for ever.
+func (l *Log) cutoff(now time.Time) time.Time {
+	if l.opts.MaxAge <= 0 {
+		return time.Time{}
+	}
+	return now.Add(-l.opts.MaxAge)
+}
+
+// compact rewrites the file with only the retained entries and appends to
+// the new file from then on. If the rewrite fails the log keeps appending to
+// the old file. It must be called with mu held (or before the log is shared).
+func (l *Log) compact() error {
+	tmp := l.path + ".tmp"
+	// Opened for appending so it can stay open once renamed into place
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = func() error {
+		for _, env := range l.entries {
+			if err := writeEntry(w, env); err != nil {
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		return os.Rename(tmp, l.path)
+	}()
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if l.f != nil {
+		l.f.Close()
+	}
+	l.f = f
+	l.w = w
+	l.lines = len(l.entries)
+	l.oldest = time.Time{}
+	if len(l.entries) > 0 {
+		l.oldest = l.entries[0].Time
+	}
+	return nil
+}
+
+func writeEntry(w *bufio.Writer, env *protocol.Envelope) error {
+	b, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	_, err = w.Write(b)
+	return err
+}
+
+// Append records env. The file is compacted once it holds twice as many
+// lines as are retained, or a line half as old again as they may be, so
+// steady traffic does not rewrite it on every message.
+func (l *Log) Append(env *protocol.Envelope) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return os.ErrClosed
+	}
+	if err := writeEntry(l.w, env); err != nil {
+		return err
+	}
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	if l.lines == 0 {
+		l.oldest = env.Time
+	}
+	l.entries = append(l.entries, env)
+	l.lines++
+	now := time.Now()
+	l.trim(now)
+
+	if l.opts.MaxMessages > 0 && l.lines >= 2*l.opts.MaxMessages {
+		return l.compact()
+	}
+	if l.opts.MaxAge > 0 && l.oldest.Before(l.cutoff(now).Add(-l.opts.MaxAge/2)) {
+		return l.compact()
+	}
+	return nil
+}
+
+// Recent returns up to n of the newest retained messages in room, oldest
+// first.
+func (l *Log) Recent(room string, n int) []*protocol.Envelope {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := l.cutoff(time.Now())
+	var out []*protocol.Envelope
+	for i := len(l.entries) - 1; i >= 0 && len(out) < n; i-- {
+		env := l.entries[i]
+		if env.Room != room || env.Time.Before(cutoff) {
+			continue
+		}
+		out = append(out, env)
+	}
+	// Reverse into chronological order
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out
+}
+
+// Close flushes and closes the log file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+	err := l.w.Flush()
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	l.f = nil
+	return err
+}
+
+// Since returns up to n of the newest retained messages in room that were
+// logged after the message with the given ID, oldest first. It reports false
+// if that message is no longer retained.
+func (l *Log) Since(room, id string, n int) ([]*protocol.Envelope, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := l.cutoff(time.Now())
+	at := -1
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		if l.entries[i].ID == id {
+			at = i
+			break
+		}
+	}
+	if at < 0 || l.entries[at].Time.Before(cutoff) {
+		return nil, false
+	}
+
+	var out []*protocol.Envelope
+	for _, env := range l.entries[at+1:] {
+		if env.Room == room && !env.Time.Before(cutoff) {
+			out = append(out, env)
+		}
+	}
+	if len(out) > n {
+		out = out[len(out)-n:]
+	}
+	return out, true
+}
@@ -0,0 +1,133 @@
+package chat
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxInputHistory is how many sent messages are remembered.
+const maxInputHistory = 500
+
+// inputHistory remembers sent messages for recall with Up and Down. Entries
+// are stored one JSON string per line so multi-line messages survive.
+type inputHistory struct {
+	path    string
+	entries []string
+	// index is the entry being shown; len(entries) means the draft.
+	index int
+	draft string
+}
+
+// defaultInputHistoryPath returns where the input history lives unless
+// configured otherwise.
+func defaultInputHistoryPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "terminal-chat", "input_history"), nil
+}
+
+// loadInputHistory reads the history at path. An empty path keeps history
+// in memory only.
+func loadInputHistory(path string) *inputHistory {
+	h := &inputHistory{path: path}
+	if path == "" {
+		return h
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read input history: %v", err)
+		}
+		return h
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 4096), 1024*1024)
+	for scanner.Scan() {
+		var entry string
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil && entry != "" {
+			h.entries = append(h.entries, entry)
+		}
+	}
+	if len(h.entries) > maxInputHistory {
+		h.entries = h.entries[len(h.entries)-maxInputHistory:]
+	}
+	h.index = len(h.entries)
+	return h
+}
+
+// add records a sent message and goes back to an empty draft. Passwords
+// never make it into the history.
+func (h *inputHistory) add(entry string) {
+	h.index = len(h.entries)
+	h.draft = ""
+	if isRegisterCommand(entry) {
+		return
+	}
+	if n := len(h.entries); n > 0 && h.entries[n-1] == entry {
+		return
+	}
+
+	h.entries = append(h.entries, entry)
+	if len(h.entries) > maxInputHistory {
+		h.entries = h.entries[len(h.entries)-maxInputHistory:]
+	}
+	h.index = len(h.entries)
+	if err := h.save(); err != nil {
+		log.Printf("Failed to save input history: %v", err)
+	}
+}
+
+// prev returns the entry before the one shown, saving current as the draft
+// when leaving it. It reports false at the oldest entry.
+func (h *inputHistory) prev(current string) (string, bool) {
+	if h.index == 0 {
+		return "", false
+	}
+	if h.index == len(h.entries) {
+		h.draft = current
+	}
+	h.index--
+	return h.entries[h.index], true
+}
+
+// next returns the entry after the one shown, or the draft after the newest
+// entry. It reports false when already at the draft.
+func (h *inputHistory) next() (string, bool) {
+	if h.index >= len(h.entries) {
+		return "", false
+	}
+	h.index++
+	if h.index == len(h.entries) {
+		return h.draft, true
+	}
+	return h.entries[h.index], true
+}
+
+func (h *inputHistory) save() error {
+	if h.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0700); err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	for _, entry := range h.entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	return os.WriteFile(h.path, []byte(b.String()), 0600)
+}
@@ -0,0 +1,99 @@
+package chat
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/rivo/tview"
+)
+
+// tagPattern matches anything tview could read as a color, style or region
+// tag.
+var tagPattern = regexp.MustCompile(`\[([^\[\]]*)\]`)
+
+// markupColors are the colors senders may use in markup mode. Black and the
+// background field are left out so text cannot be hidden.
+var markupColors = map[string]bool{
+	"":        true,
+	"-":       true,
+	"red":     true,
+	"green":   true,
+	"yellow":  true,
+	"blue":    true,
+	"purple":  true,
+	"orange":  true,
+	"aqua":    true,
+	"fuchsia": true,
+	"lime":    true,
+	"white":   true,
+	"gray":    true,
+	"violet":  true,
+}
+
+// plainText makes user supplied text safe to print into the chat view: it
+// drops control characters, which ANSIWriter would turn into colors, and
+// escapes anything that looks like a tag.
+func plainText(text string) string {
+	return tview.Escape(stripControl(text))
+}
+
+// markupText renders user supplied text that opted into markup. Only
+// foreground colors from markupColors and the bold, italic, underline and
+// dim attributes survive; every other tag is shown literally. Styles are
+// reset at the end so they cannot leak into the following lines.
+func markupText(text string) string {
+	text = tagPattern.ReplaceAllStringFunc(stripControl(text), func(tag string) string {
+		if allowedTag(tag[1 : len(tag)-1]) {
+			return tag
+		}
+		return tview.Escape(tag)
+	})
+	return text + "[-:-:-]"
+}
+
+// allowedTag reports whether the inside of a tag is a "color::attributes"
+// style from the safe subset.
+func allowedTag(tag string) bool {
+	parts := strings.Split(tag, ":")
+	if len(parts) == 0 || len(parts) > 3 || !markupColors[strings.ToLower(parts[0])] {
+		return false
+	}
+	if len(parts) > 1 && parts[1] != "" && parts[1] != "-" {
+		// No background colors
+		return false
+	}
+	if len(parts) == 3 && parts[2] != "-" && strings.Trim(parts[2], "biud") != "" {
+		return false
+	}
+	return tag != "" && tag != ":" && tag != "::"
+}
+
+func stripControl(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r != '\n' && r != '\t' && unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// messageText renders a message body according to whether its sender asked
+// for markup.
+func messageText(body string, markup bool) string {
+	if markup {
+		return markupText(body)
+	}
+	return plainText(body)
+}
+
+// systemText renders a server notice as said by the Robot. Its body is plain
+// text unless marked as markup, and color, if the server gave one, is how
+// much it should stand out.
+func systemText(body, color string, markup bool) string {
+	text := systemName + ": " + messageText(body, markup)
+	if color == "" {
+		return text
+	}
+	return color + text + "[-]"
+}
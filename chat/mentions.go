@@ -0,0 +1,64 @@
+package chat
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// mentionMatcher spots messages meant for the user: an @username or one of
+// the user's keywords, as a whole word and in any case.
+type mentionMatcher struct {
+	patterns []*regexp.Regexp
+}
+
+func newMentionMatcher(username string, keywords []string) *mentionMatcher {
+	m := &mentionMatcher{}
+	m.add("@" + username)
+	for _, kw := range keywords {
+		if kw = strings.TrimSpace(kw); kw != "" {
+			m.add(kw)
+		}
+	}
+	return m
+}
+
+func (m *mentionMatcher) add(word string) {
+	m.patterns = append(m.patterns, regexp.MustCompile(`(?i)(?:^|\W)`+regexp.QuoteMeta(word)+`(?:\W|$)`))
+}
+
+func (m *mentionMatcher) matches(body string) bool {
+	for _, p := range m.patterns {
+		if p.MatchString(body) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextMention highlights the next older mention, wrapping around to the
+// newest. It runs on the UI goroutine.
+func (ui *ChatUI) nextMention() {
+	if len(ui.mentions) == 0 {
+		ui.addLine(chatLine{text: "[yellow]No mentions yet.[-]"})
+		return
+	}
+	if ui.mentionIndex <= 0 {
+		ui.mentionIndex = len(ui.mentions)
+	}
+	ui.mentionIndex--
+	ui.ChatView.Highlight(ui.mentions[ui.mentionIndex])
+	ui.ChatView.ScrollToHighlight()
+	ui.Input.SetTitle(fmt.Sprintf(" Mention %d of %d - F3 for older, Esc to return ", len(ui.mentions)-ui.mentionIndex, len(ui.mentions)))
+}
+
+// leaveMentions stops browsing mentions and returns to the newest messages.
+func (ui *ChatUI) leaveMentions() {
+	if ui.mentionIndex < 0 {
+		return
+	}
+	ui.mentionIndex = -1
+	ui.ChatView.Highlight()
+	ui.ChatView.ScrollToEnd()
+	ui.Input.SetTitle(ui.inputTitle)
+}
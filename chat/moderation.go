@@ -0,0 +1,355 @@
+package chat
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cameroncuttingedge/terminal-chat/chat/bans"
+	"github.com/cameroncuttingedge/terminal-chat/chat/protocol"
+)
+
+// remoteIP is the address a connection comes from, without the port.
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+func (s *Server) isOperator(username string) bool {
+	for _, name := range s.config().Operators {
+		if strings.EqualFold(name, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDuration accepts anything time.ParseDuration does plus whole days,
+// such as "7d".
+func parseDuration(text string) (time.Duration, error) {
+	if days := strings.TrimSuffix(text, "d"); days != text {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", text)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(text)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", text)
+	}
+	return d, nil
+}
+
+// shortDuration formats d without trailing zero units, as in 2h or 1h30m.
+func shortDuration(d time.Duration) string {
+	if d >= 24*time.Hour && d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	text := d.String()
+	if strings.HasSuffix(text, "m0s") {
+		text = strings.TrimSuffix(text, "0s")
+	}
+	if strings.HasSuffix(text, "h0m") {
+		text = strings.TrimSuffix(text, "0m")
+	}
+	return text
+}
+
+// forDuration describes how long something lasts for announcements.
+func forDuration(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return " for " + shortDuration(d)
+}
+
+// banMessage is what a banned client is told as it is turned away.
+func banMessage(ban *bans.Ban) string {
+	text := "You are banned from this server"
+	if !ban.Expires.IsZero() {
+		text += fmt.Sprintf(" until %s", ban.Expires.UTC().Format("2006-01-02 15:04 MST"))
+	}
+	if ban.Reason != "" {
+		text += ": " + ban.Reason
+	}
+	return text + "."
+}
+
+// announce tells everyone in room about a moderation action.
+func (s *Server) announce(room, text string) {
+	s.broadcastToRoom(room, alertMessage(text))
+}
+
+// moderationTarget finds the online user an operator wants to act on,
+// telling the operator if there is none or it is another operator.
+func (s *Server) moderationTarget(op *client, username, action string) *client {
+	target := s.findClient(username)
+	if target == nil {
+		op.sendError(protocol.CodeUserOffline, fmt.Sprintf("%s is not online.", username))
+		return nil
+	}
+	if target.operator {
+		op.sendError(protocol.CodePermissionDenied, fmt.Sprintf("You cannot %s an operator.", action))
+		return nil
+	}
+	return target
+}
+
+// rejectIfMuted tells c it cannot speak if it is muted and reports whether
+// it was.
+func (s *Server) rejectIfMuted(c *client) bool {
+	s.clientMux.Lock()
+	until, muted := s.mutes[usernameKey(c.username)]
+	if muted && !until.IsZero() && time.Now().After(until) {
+		delete(s.mutes, usernameKey(c.username))
+		muted = false
+	}
+	s.clientMux.Unlock()
+
+	if !muted {
+		return false
+	}
+	if until.IsZero() {
+		c.sendError(protocol.CodeMuted, "You are muted.")
+	} else {
+		c.sendError(protocol.CodeMuted, fmt.Sprintf("You are muted for another %s.", shortDuration(time.Until(until).Round(time.Second))))
+	}
+	return true
+}
+
+// maySpeak reports whether c may say something in room right now, telling
+// it why not otherwise. Operators are exempt from slow mode.
+func (s *Server) maySpeak(c *client, room string) bool {
+	if s.rejectIfMuted(c) {
+		return false
+	}
+
+	s.clientMux.Lock()
+	interval := s.slowModes[room]
+	wait := time.Until(c.lastMessage.Add(interval))
+	if c.operator || interval == 0 || wait <= 0 {
+		c.lastMessage = time.Now()
+		s.clientMux.Unlock()
+		return true
+	}
+	s.clientMux.Unlock()
+
+	c.sendError(protocol.CodeRateLimited, fmt.Sprintf("Slow mode is on in #%s, wait %s before speaking again.", room, shortDuration(wait.Round(time.Second))))
+	return false
+}
+
+// cmdKick runs /kick <user> [reason].
+func cmdKick(s *Server, op *client, args []string) {
+	target := s.moderationTarget(op, args[0], "kick")
+	if target == nil {
+		return
+	}
+	reason := ""
+	if len(args) == 2 {
+		reason = args[1]
+	}
+
+	s.logger.Printf("[Server] '%s' kicked '%s' (%s): %s", op.username, target.username, target.ip, reason)
+	text := fmt.Sprintf("%s was kicked by %s", target.username, op.username)
+	if reason != "" {
+		text += ": " + reason
+	}
+	s.announce(s.roomOf(target), text+".")
+
+	message := fmt.Sprintf("You were kicked by %s", op.username)
+	if reason != "" {
+		message += ": " + reason
+	}
+	target.hangUp(protocol.CodeKicked, message+".")
+}
+
+// cmdBan runs /ban <user|ip> [duration] [reason]. Banning a user who is
+// online also disconnects them; banning an address disconnects everyone
+// connected from it.
+func cmdBan(s *Server, op *client, args []string) {
+	ban := bans.Ban{By: op.username, Created: time.Now().UTC()}
+	if net.ParseIP(args[0]) != nil {
+		ban.IP = args[0]
+	} else if err := validateUsername(args[0]); err != nil {
+		op.sendError(protocol.CodeBadRequest, err.Error())
+		return
+	} else {
+		ban.Username = args[0]
+	}
+
+	rest := args[1:]
+	var duration time.Duration
+	if len(rest) > 0 {
+		if d, err := parseDuration(rest[0]); err == nil {
+			duration = d
+			ban.Expires = ban.Created.Add(d)
+			rest = rest[1:]
+		}
+	}
+	ban.Reason = strings.Join(rest, " ")
+
+	if strings.EqualFold(ban.Username, op.username) || ban.IP == op.ip {
+		op.sendError(protocol.CodeBadRequest, "You cannot ban yourself.")
+		return
+	}
+	if ban.Username != "" && s.isOperator(ban.Username) {
+		op.sendError(protocol.CodePermissionDenied, "You cannot ban an operator.")
+		return
+	}
+
+	// Collect who is affected before the ban takes effect
+	var targets []*client
+	s.clientMux.Lock()
+	for _, c := range s.clients {
+		if (ban.IP != "" && c.ip == ban.IP) || (ban.Username != "" && strings.EqualFold(c.username, ban.Username)) {
+			targets = append(targets, c)
+		}
+	}
+	s.clientMux.Unlock()
+	for _, c := range targets {
+		if c.operator {
+			op.sendError(protocol.CodePermissionDenied, fmt.Sprintf("You cannot ban %s, operator %s is connected from it.", ban.IP, c.username))
+			return
+		}
+	}
+
+	if err := s.cfg.Bans.Add(ban); err != nil {
+		s.logger.Printf("[Server] Failed to save ban on %s: %v", ban.Target(), err)
+		op.sendError(protocol.CodeBadRequest, "Could not save the ban, please try again later.")
+		return
+	}
+	s.logger.Printf("[Server] '%s' banned %s%s: %s", op.username, ban.Target(), forDuration(duration), ban.Reason)
+
+	for _, c := range targets {
+		text := fmt.Sprintf("%s was banned by %s%s", c.username, op.username, forDuration(duration))
+		if ban.Reason != "" {
+			text += ": " + ban.Reason
+		}
+		s.announce(s.roomOf(c), text+".")
+		c.hangUp(protocol.CodeBanned, banMessage(&ban))
+	}
+
+	confirm := fmt.Sprintf("Banned %s%s.", ban.Target(), forDuration(duration))
+	if ban.Username != "" && len(targets) == 1 {
+		// Only operators ever see addresses, and only when they need one
+		confirm += fmt.Sprintf(" They were connecting from %s; /ban %s to ban the address too.", targets[0].ip, targets[0].ip)
+	}
+	op.enqueue(protocol.New(protocol.TypeSystem, confirm))
+}
+
+// cmdUnban runs /unban <user|ip>.
+func cmdUnban(s *Server, op *client, args []string) {
+	found, err := s.cfg.Bans.Remove(args[0])
+	if err != nil {
+		s.logger.Printf("[Server] Failed to save bans: %v", err)
+		op.sendError(protocol.CodeBadRequest, "Could not save the bans, please try again later.")
+		return
+	}
+	if !found {
+		op.sendError(protocol.CodeBadRequest, fmt.Sprintf("%s is not banned.", args[0]))
+		return
+	}
+	s.logger.Printf("[Server] '%s' lifted the ban on %s", op.username, args[0])
+	op.enqueue(protocol.New(protocol.TypeSystem, fmt.Sprintf("Lifted the ban on %s.", args[0])))
+}
+
+// cmdBans runs /bans.
+func cmdBans(s *Server, op *client, args []string) {
+	list := s.cfg.Bans.List()
+	if len(list) == 0 {
+		op.enqueue(protocol.New(protocol.TypeSystem, "Nobody is banned."))
+		return
+	}
+	lines := []string{"Bans:"}
+	for _, ban := range list {
+		line := fmt.Sprintf("  %s by %s", ban.Target(), ban.By)
+		if !ban.Expires.IsZero() {
+			line += fmt.Sprintf(" for another %s", shortDuration(time.Until(ban.Expires).Round(time.Minute)))
+		}
+		if ban.Reason != "" {
+			line += ": " + ban.Reason
+		}
+		lines = append(lines, line)
+	}
+	op.enqueue(protocol.New(protocol.TypeSystem, strings.Join(lines, "\n")))
+}
+
+// cmdMute runs /mute <user> [duration].
+func cmdMute(s *Server, op *client, args []string) {
+	target := s.moderationTarget(op, args[0], "mute")
+	if target == nil {
+		return
+	}
+	var duration time.Duration
+	if len(args) == 2 {
+		d, err := parseDuration(args[1])
+		if err != nil {
+			op.sendError(protocol.CodeBadRequest, "Durations look like 30s, 10m, 2h or 7d.")
+			return
+		}
+		duration = d
+	}
+
+	var until time.Time
+	if duration > 0 {
+		until = time.Now().Add(duration)
+	}
+	s.clientMux.Lock()
+	s.mutes[usernameKey(target.username)] = until
+	s.clientMux.Unlock()
+
+	s.logger.Printf("[Server] '%s' muted '%s'%s", op.username, target.username, forDuration(duration))
+	s.announce(s.roomOf(target), fmt.Sprintf("%s was muted by %s%s.", target.username, op.username, forDuration(duration)))
+}
+
+// cmdUnmute runs /unmute <user>.
+func cmdUnmute(s *Server, op *client, args []string) {
+	s.clientMux.Lock()
+	_, muted := s.mutes[usernameKey(args[0])]
+	delete(s.mutes, usernameKey(args[0]))
+	s.clientMux.Unlock()
+
+	if !muted {
+		op.sendError(protocol.CodeBadRequest, fmt.Sprintf("%s is not muted.", args[0]))
+		return
+	}
+	s.logger.Printf("[Server] '%s' unmuted '%s'", op.username, args[0])
+	if target := s.findClient(args[0]); target != nil {
+		s.announce(s.roomOf(target), fmt.Sprintf("%s was unmuted by %s.", target.username, op.username))
+	}
+}
+
+// cmdSlowMode runs /slowmode <seconds> for the operator's room. Zero or
+// "off" turns it off.
+func cmdSlowMode(s *Server, op *client, args []string) {
+	seconds, err := strconv.Atoi(args[0])
+	if args[0] == "off" {
+		seconds, err = 0, nil
+	}
+	if err != nil || seconds < 0 {
+		op.sendError(protocol.CodeBadRequest, "Usage: /slowmode <seconds>, or 0 to turn it off")
+		return
+	}
+
+	s.clientMux.Lock()
+	room := op.room
+	if seconds == 0 {
+		delete(s.slowModes, room)
+	} else {
+		s.slowModes[room] = time.Duration(seconds) * time.Second
+	}
+	s.clientMux.Unlock()
+
+	s.logger.Printf("[Server] '%s' set slow mode in #%s to %ds", op.username, room, seconds)
+	if seconds == 0 {
+		s.announce(room, fmt.Sprintf("%s turned off slow mode.", op.username))
+	} else {
+		s.announce(room, fmt.Sprintf("%s turned on slow mode: one message every %d seconds.", op.username, seconds))
+	}
+}
@@ -0,0 +1,147 @@
+package chat
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cameroncuttingedge/terminal-chat/chat/protocol"
+)
+
+// status returns c's presence status. It must be called with clientMux held.
+func (c *client) status() string {
+	switch {
+	case c.away:
+		return protocol.StatusAway
+	case c.idle:
+		return protocol.StatusIdle
+	default:
+		return protocol.StatusActive
+	}
+}
+
+// roster lists everyone in room, sorted by name.
+func (s *Server) roster(room string) []protocol.RosterEntry {
+	s.clientMux.Lock()
+	users := []protocol.RosterEntry{}
+	for _, other := range s.clients {
+		if other.room != room {
+			continue
+		}
+		users = append(users, protocol.RosterEntry{
+			Name:   other.username,
+			Color:  other.color,
+			Status: other.status(),
+			Away:   other.awayReason,
+			RTT:    other.rtt.Milliseconds(),
+		})
+	}
+	s.clientMux.Unlock()
+
+	sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+	return users
+}
+
+// sendRoster sends c a snapshot of everyone in room. Clients replace their
+// user list with it, so it is sent whenever c enters a room or reconnects.
+func (s *Server) sendRoster(c *client, room string) {
+	roster := protocol.New(protocol.TypeRoster, "")
+	roster.Room = room
+	roster.Users = s.roster(room)
+	c.enqueue(roster)
+}
+
+// announcePresence tells c's room about its current status.
+func (s *Server) announcePresence(c *client) {
+	s.clientMux.Lock()
+	env := protocol.New(protocol.TypePresence, c.awayReason)
+	env.From = c.username
+	env.Room = c.room
+	env.Status = c.status()
+	s.clientMux.Unlock()
+
+	s.logger.Printf("[Server] '%s' is now %s", env.From, env.Status)
+	s.broadcastToRoom(env.Room, env)
+}
+
+// markActive records that c just did something, bringing it back from idle.
+func (s *Server) markActive(c *client) {
+	s.clientMux.Lock()
+	c.lastActive = time.Now()
+	// Away trumps idle, so nobody needs to hear about it
+	changed := c.idle && !c.away
+	c.idle = false
+	s.clientMux.Unlock()
+
+	if changed {
+		s.announcePresence(c)
+	}
+}
+
+// checkIdle marks clients that have not said anything for IdleAfter as idle.
+func (s *Server) checkIdle() {
+	now := time.Now()
+	idleAfter := s.config().IdleAfter
+	var idled []*client
+
+	s.clientMux.Lock()
+	for _, c := range s.clients {
+		if !c.idle && now.Sub(c.lastActive) > idleAfter {
+			c.idle = true
+			if !c.away {
+				idled = append(idled, c)
+			}
+		}
+	}
+	s.clientMux.Unlock()
+
+	for _, c := range idled {
+		s.announcePresence(c)
+	}
+}
+
+func cmdAway(s *Server, c *client, args []string) {
+	s.clientMux.Lock()
+	c.away = true
+	c.awayReason = ""
+	if len(args) == 1 {
+		c.awayReason = args[0]
+	}
+	s.clientMux.Unlock()
+	s.announcePresence(c)
+}
+
+func cmdBack(s *Server, c *client, args []string) {
+	s.clientMux.Lock()
+	wasAway := c.away
+	c.away = false
+	c.awayReason = ""
+	s.clientMux.Unlock()
+
+	if !wasAway {
+		c.sendError(protocol.CodeBadRequest, "You are not away.")
+		return
+	}
+	s.announcePresence(c)
+}
+
+func cmdWho(s *Server, c *client, args []string) {
+	room := s.roomOf(c)
+	users := s.roster(room)
+
+	// Answer in plain text too, for clients without a user list
+	names := make([]string, 0, len(users))
+	for _, u := range users {
+		if u.Status == protocol.StatusActive {
+			names = append(names, u.Name)
+		} else {
+			names = append(names, fmt.Sprintf("%s (%s)", u.Name, u.Status))
+		}
+	}
+	roster := protocol.New(protocol.TypeRoster, "")
+	roster.Room = room
+	roster.Users = users
+	c.enqueue(roster)
+	c.enqueue(protocol.New(protocol.TypeSystem, fmt.Sprintf("%d in #%s: %s", len(users), room, strings.Join(names, ", "))))
+}
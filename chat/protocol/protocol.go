@@ -0,0 +1,257 @@
+// Package protocol defines the wire format shared by the chat server and its
+// clients. Every frame is a single JSON encoded Envelope terminated by a
+// newline, so control messages can never be confused with chat text.
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Version is the newest protocol version this build speaks. Version 2 added
+// pong frames.
+const Version = 2
+
+// MinVersion is the oldest protocol version this build still accepts.
+const MinVersion = 1
+
+// MaxFrameSize is the largest frame a Decoder made by NewDecoder will accept.
+const MaxFrameSize = 64 * 1024
+
+// Type identifies the kind of message carried by an Envelope. Receivers must
+// ignore types they do not know so new kinds can be added without breaking
+// older peers.
+type Type string
+
+const (
+	TypeHello    Type = "hello"    // client -> server, first frame: version, username, optional password and resume state
+	TypeWelcome  Type = "welcome"  // server -> client: negotiated version, assigned color, room and resume token
+	TypeChat     Type = "chat"     // a chat message from a user
+	TypeDirect   Type = "direct"   // a private message, see From and To
+	TypeSystem   Type = "system"   // server notices such as command output, see Body and, for alerts, Color
+	TypeJoin     Type = "join"     // a user joined a room, see From, Color and Room
+	TypeLeave    Type = "leave"    // a user left a room, see From and Room
+	TypePing     Type = "ping"     // server heartbeat
+	TypePong     Type = "pong"     // client -> server answer to a ping, carrying the ping's ID
+	TypeError    Type = "error"    // request failed, see Code
+	TypeRoster   Type = "roster"   // everyone in Room, see Users; replaces any earlier roster
+	TypePresence Type = "presence" // a user's Status in Room changed, Body holds an away message
+	TypeShutdown Type = "shutdown" // the server is going away, Body holds the reason; see Restart
+)
+
+// Presence statuses carried in Status and RosterEntry.Status.
+const (
+	StatusActive = "active"
+	StatusIdle   = "idle"
+	StatusAway   = "away"
+)
+
+// RosterEntry describes one user in a roster frame.
+type RosterEntry struct {
+	Name   string `json:"name"`
+	Color  string `json:"color,omitempty"`
+	Status string `json:"status,omitempty"`
+	// Away is the user's away message, if any.
+	Away string `json:"away,omitempty"`
+	// RTT is the user's last measured heartbeat round trip in milliseconds.
+	RTT int64 `json:"rtt_ms,omitempty"`
+}
+
+// Error codes carried in the Code field of TypeError envelopes.
+const (
+	CodeUsernameTaken      = "username_taken"
+	CodeUnsupportedVersion = "unsupported_version"
+	CodeBadRequest         = "bad_request"
+	CodeUserOffline        = "user_offline"
+	CodeAuthRequired       = "auth_required"
+	CodeAuthFailed         = "auth_failed"
+	CodeUnknownCommand     = "unknown_command"
+	CodePermissionDenied   = "permission_denied"
+	CodeMuted              = "muted"
+	CodeRateLimited        = "rate_limited"
+	CodeTooLong            = "too_long"
+	// CodeKicked and CodeBanned are the last frame before the server hangs
+	// up; clients should not reconnect on their own.
+	CodeKicked = "kicked"
+	CodeBanned = "banned"
+)
+
+// Envelope is a single protocol frame. From is only meaningful in hello
+// frames sent by clients and in frames sent by the server, which always fills
+// it in from the authenticated connection. Fields may contain newlines, which
+// JSON escapes, so a multi-line Body still travels as one frame.
+type Envelope struct {
+	Version int       `json:"v,omitempty"`
+	Type    Type      `json:"type"`
+	ID      string    `json:"id,omitempty"`
+	From    string    `json:"from,omitempty"`
+	To      string    `json:"to,omitempty"`
+	Time    time.Time `json:"ts"`
+	Body    string    `json:"body,omitempty"`
+	Color   string    `json:"color,omitempty"`
+	Room    string    `json:"room,omitempty"`
+	// History marks messages replayed from the server's log rather than
+	// said just now.
+	History bool `json:"history,omitempty"`
+	// Markup marks a Body that may contain the sender's own color and style
+	// tags. Clients render it with a restricted set of tags; any other Body
+	// is plain text and must be shown literally.
+	Markup bool   `json:"markup,omitempty"`
+	Code   string `json:"code,omitempty"`
+	// Password is only sent in hello frames.
+	Password string `json:"password,omitempty"`
+	// Token is the resume token handed out in welcome frames. Clients send
+	// it back in their hello, together with the ID of the last chat message
+	// they saw in LastID, to pick up where they left off.
+	Token  string `json:"token,omitempty"`
+	LastID string `json:"last_id,omitempty"`
+	// Commands lists the commands the user may run. Sent in welcome frames.
+	Commands []string `json:"commands,omitempty"`
+	// Users and Status are used by roster and presence frames.
+	Users  []RosterEntry `json:"users,omitempty"`
+	Status string        `json:"status,omitempty"`
+	// Restart is set in shutdown frames when the server expects to be back
+	// shortly, so clients should reconnect.
+	Restart bool `json:"restart,omitempty"`
+}
+
+// ErrMalformed is returned by Decode when a frame is not a valid envelope.
+// The stream is still usable afterwards.
+var ErrMalformed = errors.New("protocol: malformed frame")
+
+// ErrFrameTooLarge is returned by Decode when a frame is longer than the
+// Decoder's limit. The frame is skipped without being kept in memory and the
+// stream is still usable afterwards.
+var ErrFrameTooLarge = errors.New("protocol: frame too large")
+
+// New returns an envelope of the given type stamped with a fresh ID and the
+// current time.
+func New(t Type, body string) *Envelope {
+	return &Envelope{
+		Type: t,
+		ID:   NewID(),
+		Time: time.Now().UTC(),
+		Body: body,
+	}
+}
+
+// NewID returns a random identifier suitable for Envelope.ID.
+func NewID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// Negotiate returns the version both sides should speak given the version a
+// peer announced in its hello.
+func Negotiate(peer int) (int, error) {
+	if peer < MinVersion {
+		return 0, fmt.Errorf("protocol: version %d is not supported (min %d)", peer, MinVersion)
+	}
+	if peer > Version {
+		return Version, nil
+	}
+	return peer, nil
+}
+
+// Encoder writes envelopes to a stream. It is safe for concurrent use.
+type Encoder struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes env as a single frame.
+func (e *Encoder) Encode(env *Envelope) error {
+	b, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(b)
+	return err
+}
+
+// Decoder reads envelopes from a stream.
+type Decoder struct {
+	r   *bufio.Reader
+	max int
+	buf []byte
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return NewDecoderSize(r, MaxFrameSize)
+}
+
+// NewDecoderSize returns a Decoder that accepts frames of up to max bytes.
+func NewDecoderSize(r io.Reader, max int) *Decoder {
+	return &Decoder{r: bufio.NewReaderSize(r, 4096), max: max}
+}
+
+// Decode reads the next frame into env. It returns io.EOF when the stream
+// ends cleanly, ErrMalformed for frames that cannot be parsed and
+// ErrFrameTooLarge for frames over the limit.
+func (d *Decoder) Decode(env *Envelope) error {
+	line, err := d.readLine()
+	if err != nil {
+		return err
+	}
+	*env = Envelope{}
+	if err := json.Unmarshal(line, env); err != nil || env.Type == "" {
+		return ErrMalformed
+	}
+	return nil
+}
+
+// readLine returns the next line without its line ending. Once a line grows
+// past the limit the rest of it is read and thrown away.
+func (d *Decoder) readLine() ([]byte, error) {
+	d.buf = d.buf[:0]
+	tooLarge := false
+	for {
+		chunk, err := d.r.ReadSlice('\n')
+		if !tooLarge {
+			if len(d.buf)+len(chunk) > d.max+2 { // room for "\r\n"
+				tooLarge = true
+				d.buf = d.buf[:0]
+			} else {
+				d.buf = append(d.buf, chunk...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(d.buf) > 0 && !tooLarge {
+			// A last line without a newline still counts
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if tooLarge {
+			return nil, ErrFrameTooLarge
+		}
+		line := bytes.TrimSuffix(d.buf, []byte("\n"))
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) > d.max {
+			return nil, ErrFrameTooLarge
+		}
+		return line, nil
+	}
+}
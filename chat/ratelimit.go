@@ -0,0 +1,218 @@
+package chat
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cameroncuttingedge/terminal-chat/chat/protocol"
+)
+
+// Flood escalation. Every frame refused by a rate limit, or too long to
+// read, is a strike; strikes are forgotten after strikeDecay without one.
+// Frames refused by a rate limit are answered with a warning once per run
+// of strikes and a pause in reading every time, so the flood backs up in the
+// sender's socket rather than our memory. The muteAfterStrikes-th strike
+// earns a FloodMute and the disconnectAfterStrikes-th the door.
+const (
+	strikeDecay            = 30 * time.Second
+	muteAfterStrikes       = 10
+	disconnectAfterStrikes = 20
+	maxThrottle            = 2 * time.Second
+)
+
+// tokenBucket allows rate events per second on average and bursts of up to
+// burst events. It is not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// setLimit changes the bucket's rate and burst, as after a Reload.
+func (b *tokenBucket) setLimit(rate float64, burst int) {
+	b.rate = rate
+	b.burst = float64(burst)
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// take uses up a token if there is one. Otherwise it reports how long until
+// there will be.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// full reports whether the bucket has refilled completely.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// addressLimits holds a token bucket for every address with clients
+// connected, shared by all of them.
+type addressLimits struct {
+	mu      sync.Mutex
+	buckets map[string]*addressBucket
+}
+
+type addressBucket struct {
+	*tokenBucket
+	conns int
+}
+
+// connectFrom takes a token for a new connection from ip. It reports false if
+// the address is over its limit, in which case the connection is not counted.
+func (s *Server) connectFrom(ip string) bool {
+	cfg := s.config()
+	l := &s.addrLimits
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &addressBucket{tokenBucket: newTokenBucket(cfg.IPMessageRate, cfg.IPMessageBurst)}
+		l.buckets[ip] = b
+	}
+	b.setLimit(cfg.IPMessageRate, cfg.IPMessageBurst)
+	if ok, _ := b.take(time.Now()); !ok {
+		return false
+	}
+	b.conns++
+	return true
+}
+
+// disconnectFrom forgets a connection counted by connectFrom.
+func (s *Server) disconnectFrom(ip string) {
+	l := &s.addrLimits
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b, ok := l.buckets[ip]; ok {
+		b.conns--
+	}
+}
+
+// takeFromAddress uses up a token from ip's shared bucket, limited to rate
+// and burst.
+func (s *Server) takeFromAddress(ip string, now time.Time, rate float64, burst int) (bool, time.Duration) {
+	l := &s.addrLimits
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[ip]
+	if !ok {
+		return true, 0
+	}
+	b.setLimit(rate, burst)
+	return b.take(now)
+}
+
+// expireAddressLimits drops the buckets of addresses nobody is connected
+// from once they have refilled, so they cannot be reset by reconnecting.
+func (s *Server) expireAddressLimits() {
+	l := &s.addrLimits
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for ip, b := range l.buckets {
+		if b.conns <= 0 && b.full(now) {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// allowFrame charges a frame from c to its own and its address's rate
+// limits, escalating if either is exhausted. It reports whether the frame
+// may be handled. It runs on c's read loop.
+func (s *Server) allowFrame(c *client) bool {
+	cfg := s.config()
+	now := time.Now()
+	c.limit.setLimit(cfg.MessageRate, cfg.MessageBurst)
+	ok, wait := c.limit.take(now)
+	if ok {
+		if ok, wait = s.takeFromAddress(c.ip, now, cfg.IPMessageRate, cfg.IPMessageBurst); !ok {
+			// Give back the client's token, the frame is not going anywhere
+			c.limit.tokens++
+		}
+	}
+	if ok {
+		return true
+	}
+	s.countStat(&s.stats.RateLimited)
+	s.strike(c)
+	if !c.warned {
+		c.warned = true
+		s.logger.Printf("[Server] '%s' (%s) hit a rate limit", c.username, c.ip)
+		c.sendError(protocol.CodeRateLimited, "You are sending too fast, slow down or you will be muted.")
+	}
+	throttle(c, wait)
+	return false
+}
+
+// strike records a strike against c, muting or disconnecting it as
+// described at strikeDecay. It runs on c's read loop.
+func (s *Server) strike(c *client) {
+	now := time.Now()
+	if now.Sub(c.lastStrike) > strikeDecay {
+		c.strikes = 0
+		c.warned = false
+		c.warnedMalformed = false
+	}
+	c.strikes++
+	c.lastStrike = now
+
+	switch c.strikes {
+	case muteAfterStrikes:
+		s.floodMute(c)
+	case disconnectAfterStrikes:
+		s.logger.Printf("[Server] Disconnecting '%s' (%s) for flooding", c.username, c.ip)
+		s.countStat(&s.stats.FloodDisconnects)
+		s.announce(s.roomOf(c), fmt.Sprintf("%s was disconnected for flooding.", c.username))
+		c.hangUp(protocol.CodeKicked, "You were disconnected for flooding.")
+	}
+}
+
+// throttle stops reading from c until its next token is due, at most
+// maxThrottle, or it is disconnected.
+func throttle(c *client, wait time.Duration) {
+	if wait > maxThrottle {
+		wait = maxThrottle
+	}
+	select {
+	case <-time.After(wait):
+	case <-c.done:
+	}
+}
+
+// floodMute mutes c for Config.FloodMute unless it is muted for longer
+// already.
+func (s *Server) floodMute(c *client) {
+	mute := s.config().FloodMute
+	until := time.Now().Add(mute)
+	s.clientMux.Lock()
+	current, muted := s.mutes[usernameKey(c.username)]
+	if !muted || (!current.IsZero() && current.Before(until)) {
+		s.mutes[usernameKey(c.username)] = until
+	}
+	s.clientMux.Unlock()
+
+	s.logger.Printf("[Server] Muting '%s' (%s) for flooding", c.username, c.ip)
+	s.countStat(&s.stats.FloodMutes)
+	s.announce(s.roomOf(c), fmt.Sprintf("%s was muted%s for flooding.", c.username, forDuration(mute)))
+}
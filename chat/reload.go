@@ -0,0 +1,164 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// setDefaults fills in the zero values of cfg, except for the stores.
+func setDefaults(cfg *Config) {
+	if cfg.Port == 0 {
+		cfg.Port = 9999
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.Default()
+	}
+	if cfg.SendQueueSize <= 0 {
+		cfg.SendQueueSize = 64
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = 10 * time.Second
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = 5 * time.Second
+	}
+	if cfg.ClientTimeout <= 0 {
+		cfg.ClientTimeout = 30 * time.Second
+	}
+	if cfg.IdleAfter <= 0 {
+		cfg.IdleAfter = 5 * time.Minute
+	}
+	if cfg.ClientTimeout < 2*cfg.HeartbeatInterval {
+		cfg.ClientTimeout = 2 * cfg.HeartbeatInterval
+	}
+	if len(cfg.Colors) == 0 {
+		cfg.Colors = DefaultColors
+	}
+	rooms := make([]Room, len(cfg.Rooms))
+	for i, room := range cfg.Rooms {
+		room.Name, _ = normalizeRoomName(room.Name)
+		rooms[i] = room
+	}
+	cfg.Rooms = rooms
+	if cfg.ResumeWindow <= 0 {
+		cfg.ResumeWindow = 10 * time.Minute
+	}
+	if cfg.MaxLineLength <= 0 {
+		cfg.MaxLineLength = 16 * 1024
+	}
+	if cfg.MessageRate <= 0 {
+		cfg.MessageRate = 2
+	}
+	if cfg.MessageBurst <= 0 {
+		cfg.MessageBurst = 10
+	}
+	if cfg.IPMessageRate <= 0 {
+		cfg.IPMessageRate = 5
+	}
+	if cfg.IPMessageBurst <= 0 {
+		cfg.IPMessageBurst = 30
+	}
+	if cfg.FloodMute <= 0 {
+		cfg.FloodMute = time.Minute
+	}
+	if cfg.HistoryReplay <= 0 {
+		cfg.HistoryReplay = 25
+	}
+	if cfg.HistoryReplay > cfg.SendQueueSize/2 {
+		cfg.Logger.Printf("[Server] Capping history replay at %d messages to fit the send queue", cfg.SendQueueSize/2)
+		cfg.HistoryReplay = cfg.SendQueueSize / 2
+	}
+}
+
+// Validate reports settings in cfg that cannot work.
+func (cfg *Config) Validate() error {
+	for _, color := range cfg.Colors {
+		name := strings.TrimSuffix(strings.TrimPrefix(color, "["), "]")
+		if name == color || tcell.GetColor(name) == tcell.ColorDefault {
+			return fmt.Errorf("unknown color %q, use a color tag such as [orange] or [#FFC0CB]", color)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, room := range cfg.Rooms {
+		name, err := normalizeRoomName(room.Name)
+		if err != nil {
+			return fmt.Errorf("room %q: %s", room.Name, strings.TrimSuffix(err.Error(), "."))
+		}
+		if seen[name] {
+			return fmt.Errorf("room #%s is listed twice", name)
+		}
+		seen[name] = true
+	}
+	if cfg.RequireAuth && cfg.Users == nil {
+		return errors.New("requiring accounts needs a user store")
+	}
+	if len(cfg.Operators) > 0 && cfg.Users == nil {
+		return errors.New("operators need a user store")
+	}
+	return nil
+}
+
+// config returns the server's current settings. Anything Reload can change
+// must be read through it rather than from s.cfg.
+func (s *Server) config() Config {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.cfg
+}
+
+// Reload applies the settings in cfg that can change without dropping
+// anyone: timeouts, heartbeat, the overflow policy, colors, MOTD, rooms,
+// RequireAuth, operators, history replay and flood protection. Zero values
+// fall back to defaults as in NewServer. Addresses, TLS, the stores, hooks,
+// logger and send queue size are fixed when the server is made and are
+// ignored here.
+//
+// New colors are handed out to users as they join, a new MaxLineLength
+// applies to new connections and operators gain or lose the role when they
+// next log in. Nothing is changed if cfg does not Validate.
+func (s *Server) Reload(cfg Config) error {
+	// Fixed settings come from the running server, so the checks and
+	// defaults below see what is actually in use
+	cfg.Port = s.cfg.Port
+	cfg.Listen = s.cfg.Listen
+	cfg.TLSConfig = s.cfg.TLSConfig
+	cfg.Logger = s.logger
+	cfg.Hooks = s.cfg.Hooks
+	cfg.SendQueueSize = s.cfg.SendQueueSize
+	cfg.Users = s.cfg.Users
+	cfg.Bans = s.cfg.Bans
+	cfg.History = s.cfg.History
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	setDefaults(&cfg)
+
+	s.cfgMu.Lock()
+	s.cfg.WriteTimeout = cfg.WriteTimeout
+	s.cfg.Overflow = cfg.Overflow
+	s.cfg.HeartbeatInterval = cfg.HeartbeatInterval
+	s.cfg.ClientTimeout = cfg.ClientTimeout
+	s.cfg.IdleAfter = cfg.IdleAfter
+	s.cfg.Colors = cfg.Colors
+	s.cfg.MOTD = cfg.MOTD
+	s.cfg.Rooms = cfg.Rooms
+	s.cfg.RequireAuth = cfg.RequireAuth
+	s.cfg.Operators = cfg.Operators
+	s.cfg.ResumeWindow = cfg.ResumeWindow
+	s.cfg.HistoryReplay = cfg.HistoryReplay
+	s.cfg.MaxLineLength = cfg.MaxLineLength
+	s.cfg.MessageRate = cfg.MessageRate
+	s.cfg.MessageBurst = cfg.MessageBurst
+	s.cfg.IPMessageRate = cfg.IPMessageRate
+	s.cfg.IPMessageBurst = cfg.IPMessageBurst
+	s.cfg.FloodMute = cfg.FloodMute
+	s.cfgMu.Unlock()
+
+	s.logger.Printf("[Server] Reloaded settings")
+	return nil
+}
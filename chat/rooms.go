@@ -0,0 +1,172 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cameroncuttingedge/terminal-chat/chat/protocol"
+)
+
+// DefaultRoom is the room every client starts in and returns to on /part.
+const DefaultRoom = "lobby"
+
+const maxRoomNameLength = 32
+
+// Room is a room configured on the server. Configured rooms are listed by
+// /rooms even when empty, and their topic is shown to whoever enters them.
+type Room struct {
+	Name  string `json:"name"`
+	Topic string `json:"topic,omitempty"`
+}
+
+type roomChange struct {
+	client *client
+	room   string
+}
+
+// normalizeRoomName strips a leading '#' and validates what is left.
+func normalizeRoomName(name string) (string, error) {
+	name = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "#"))
+	if name == "" {
+		return "", errors.New("Room name must not be empty.")
+	}
+	if len(name) > maxRoomNameLength {
+		return "", fmt.Errorf("Room name must be at most %d characters.", maxRoomNameLength)
+	}
+	if strings.ContainsAny(name, " \t[]") {
+		return "", errors.New("Room name must not contain spaces or brackets.")
+	}
+	return name, nil
+}
+
+// prepareRoomChange moves a client between rooms and tells both rooms about
+// it. It runs on the broadcast goroutine.
+func (s *Server) prepareRoomChange(change roomChange) {
+	c := change.client
+
+	s.clientMux.Lock()
+	oldRoom := c.room
+	if oldRoom == change.room {
+		s.clientMux.Unlock()
+		c.sendError(protocol.CodeBadRequest, fmt.Sprintf("You are already in #%s.", change.room))
+		return
+	}
+	c.room = change.room
+	s.clientMux.Unlock()
+
+	s.logger.Printf("[Server] '%s' moved from #%s to #%s", c.username, oldRoom, change.room)
+
+	left := protocol.New(protocol.TypeLeave, "")
+	left.From = c.username
+	left.Room = oldRoom
+	s.broadcastToRoom(oldRoom, left)
+
+	joined := protocol.New(protocol.TypeJoin, "")
+	joined.From = c.username
+	joined.Color = c.color
+	joined.Room = change.room
+	s.replayHistory(c, change.room)
+	s.sendRoster(c, change.room)
+	s.sendTopic(c, change.room)
+	s.broadcastToRoom(change.room, joined)
+}
+
+// requestRoomChange hands a room change to the broadcast goroutine.
+func (s *Server) requestRoomChange(c *client, room string) {
+	select {
+	case s.roomChanges <- roomChange{client: c, room: room}:
+	case <-s.quit:
+	}
+}
+
+// roomOf returns the room the client is currently in.
+func (s *Server) roomOf(c *client) string {
+	s.clientMux.Lock()
+	defer s.clientMux.Unlock()
+	return c.room
+}
+
+func (s *Server) broadcastToRoom(room string, env *protocol.Envelope) {
+	s.clientMux.Lock()
+	defer s.clientMux.Unlock()
+
+	for _, c := range s.clients {
+		if c.room != room {
+			continue
+		}
+		c.enqueue(env)
+		s.logger.Printf("[Server] Queued %s message %s for client: %s in #%s", env.Type, env.ID, c.username, room)
+	}
+}
+
+// sendTopic tells c the topic of room, if it has one.
+func (s *Server) sendTopic(c *client, room string) {
+	if topic := s.topicOf(room); topic != "" {
+		c.enqueue(protocol.New(protocol.TypeSystem, fmt.Sprintf("Topic for #%s: %s", room, topic)))
+	}
+}
+
+func (s *Server) topicOf(room string) string {
+	for _, r := range s.config().Rooms {
+		if r.Name == room {
+			return r.Topic
+		}
+	}
+	return ""
+}
+
+// roomList renders every non-empty room, plus the default and configured
+// rooms, with its member count and topic.
+func (s *Server) roomList() string {
+	counts := map[string]int{DefaultRoom: 0}
+	topics := make(map[string]string)
+	for _, r := range s.config().Rooms {
+		counts[r.Name] = 0
+		topics[r.Name] = r.Topic
+	}
+
+	s.clientMux.Lock()
+	for _, c := range s.clients {
+		counts[c.room]++
+	}
+	s.clientMux.Unlock()
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		line := fmt.Sprintf("  #%s (%d)", name, counts[name])
+		if topics[name] != "" {
+			line += " - " + topics[name]
+		}
+		lines = append(lines, line)
+	}
+	return "Rooms:\n" + strings.Join(lines, "\n")
+}
+
+func cmdJoin(s *Server, c *client, args []string) {
+	room, err := normalizeRoomName(args[0])
+	if err != nil {
+		c.sendError(protocol.CodeBadRequest, err.Error())
+		return
+	}
+	s.requestRoomChange(c, room)
+}
+
+func cmdPart(s *Server, c *client, args []string) {
+	if s.roomOf(c) == DefaultRoom {
+		c.sendError(protocol.CodeBadRequest, fmt.Sprintf("You cannot leave #%s.", DefaultRoom))
+		return
+	}
+	s.requestRoomChange(c, DefaultRoom)
+}
+
+func cmdRooms(s *Server, c *client, args []string) {
+	c.enqueue(protocol.New(protocol.TypeSystem, s.roomList()))
+}
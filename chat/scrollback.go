@@ -0,0 +1,181 @@
+package chat
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rivo/tview"
+)
+
+// Ways of showing message times, chosen with -time-format.
+const (
+	timeClock    = "clock"
+	timeRelative = "relative"
+	timeOff      = "off"
+)
+
+// relativeRefresh is how often relative times are brought up to date.
+const relativeRefresh = 30 * time.Second
+
+// chatLine is one entry in the chat view. Lines without a time, such as the
+// history markers, get no time prefix.
+type chatLine struct {
+	time   time.Time
+	text   string
+	region string // set on mentions so they can be jumped to
+}
+
+// printToChat appends an untimed line to the chat view from any goroutine.
+func (ui *ChatUI) printToChat(text string) {
+	ui.appendLine(time.Time{}, text, false)
+}
+
+// printLine appends a line said at t to the chat view from any goroutine.
+func (ui *ChatUI) printLine(t time.Time, text string) {
+	ui.appendLine(t, text, false)
+}
+
+// printMention appends a highlighted line said at t and remembers it for
+// /mentions. Each mention is its own region so it can be jumped to.
+func (ui *ChatUI) printMention(t time.Time, text string) {
+	ui.appendLine(t, text, true)
+}
+
+func (ui *ChatUI) appendLine(t time.Time, text string, mention bool) {
+	ui.App.QueueUpdateDraw(func() {
+		line := chatLine{time: t, text: text}
+		if mention {
+			line.region = fmt.Sprintf("mention-%d", len(ui.mentions))
+			ui.mentions = append(ui.mentions, line.region)
+		}
+		ui.addLine(line)
+	})
+}
+
+// addLine adds line to the scrollback and draws it. It runs on the UI
+// goroutine, or before the app starts.
+func (ui *ChatUI) addLine(line chatLine) {
+	ui.lines = append(ui.lines, line)
+
+	var b strings.Builder
+	ui.renderLine(&b, line)
+	fmt.Fprint(ui.ChatView, b.String())
+	if ui.mentionIndex < 0 {
+		// Stay put while the user is looking at an old mention
+		ui.ChatView.ScrollToEnd()
+	}
+}
+
+// renderLine writes line to b, preceded by a day separator when its date
+// differs from that of the line before it. It runs on the UI goroutine.
+func (ui *ChatUI) renderLine(b *strings.Builder, line chatLine) {
+	w := tview.ANSIWriter(b)
+	if !line.time.IsZero() {
+		local := line.time.Local()
+		if day := local.Format("2006-01-02"); day != ui.lastDay {
+			fmt.Fprintf(w, "[gray]──── %s ────[-]\n", local.Format("Monday, 2 January 2006"))
+			ui.lastDay = day
+		}
+	}
+
+	text := ui.timePrefix(line.time) + line.text
+	if line.region != "" {
+		text = fmt.Sprintf("[\"%s\"][black:yellow]@[-:-] %s[\"\"]", line.region, text)
+	}
+	fmt.Fprintln(w, text)
+}
+
+// timePrefix formats t for the start of a line in the user's time zone.
+func (ui *ChatUI) timePrefix(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	switch ui.timeFormat {
+	case timeClock:
+		return fmt.Sprintf("[gray]%s[-] ", t.Local().Format("15:04"))
+	case timeRelative:
+		return fmt.Sprintf("[gray]%4s[-] ", relativeTime(time.Since(t)))
+	default:
+		return ""
+	}
+}
+
+func relativeTime(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return "now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d/time.Minute))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(d/time.Hour))
+	default:
+		return fmt.Sprintf("%dd", int(d/(24*time.Hour)))
+	}
+}
+
+// redrawChat renders the whole scrollback again so relative times stay
+// current. It runs on the UI goroutine.
+func (ui *ChatUI) redrawChat() {
+	ui.lastDay = time.Now().Format("2006-01-02")
+	var b strings.Builder
+	for _, line := range ui.lines {
+		ui.renderLine(&b, line)
+	}
+	ui.ChatView.SetText(b.String())
+
+	if ui.mentionIndex >= 0 {
+		ui.ChatView.Highlight(ui.mentions[ui.mentionIndex])
+		ui.ChatView.ScrollToHighlight()
+	} else {
+		ui.ChatView.ScrollToEnd()
+	}
+}
+
+// refreshRelativeTimes keeps relative times current until the app stops.
+func (ui *ChatUI) refreshRelativeTimes() {
+	if ui.timeFormat != timeRelative {
+		return
+	}
+	ticker := time.NewTicker(relativeRefresh)
+	defer ticker.Stop()
+	for range ticker.C {
+		ui.App.QueueUpdateDraw(ui.redrawChat)
+	}
+}
+
+// export saves the transcript to path, or to a timestamped file in the
+// working directory if path is empty. It runs on the UI goroutine.
+func (ui *ChatUI) export(path string) {
+	if path == "" {
+		path = time.Now().Format("terminal-chat-20060102-150405.txt")
+	}
+	if err := ui.exportTranscript(path); err != nil {
+		ui.addLine(chatLine{text: fmt.Sprintf("[red]Export failed: %s[-]", plainText(err.Error()))})
+		return
+	}
+	ui.addLine(chatLine{text: fmt.Sprintf("[green]Saved %d lines to %s.[-]", len(ui.lines), plainText(path))})
+}
+
+// exportTranscript writes the scrollback to path as plain text, each line
+// stamped with its full local date and time. It runs on the UI goroutine.
+func (ui *ChatUI) exportTranscript(path string) error {
+	var b strings.Builder
+	for _, line := range ui.lines {
+		text := stripTags(line.text)
+		if !line.time.IsZero() {
+			text = line.time.Local().Format("2006-01-02 15:04:05") + " " + text
+		}
+		b.WriteString(strings.TrimRight(text, "\n"))
+		b.WriteByte('\n')
+	}
+	return os.WriteFile(path, []byte(b.String()), 0600)
+}
+
+// stripTags turns a line meant for the chat view into plain text.
+func stripTags(text string) string {
+	view := tview.NewTextView().SetDynamicColors(true).SetRegions(true)
+	fmt.Fprint(tview.ANSIWriter(view), text)
+	return view.GetText(true)
+}
@@ -0,0 +1,123 @@
+package chat
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cameroncuttingedge/terminal-chat/chat/protocol"
+)
+
+// OverflowPolicy decides what happens when a client's send queue is full.
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest queued message to make room.
+	DropOldest OverflowPolicy = iota
+	// DisconnectSlow drops the connection of a client that cannot keep up.
+	DisconnectSlow
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop-oldest"
+	case DisconnectSlow:
+		return "disconnect"
+	default:
+		return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+	}
+}
+
+// Set implements flag.Value.
+func (p *OverflowPolicy) Set(s string) error {
+	switch s {
+	case "drop-oldest":
+		*p = DropOldest
+	case "disconnect":
+		*p = DisconnectSlow
+	default:
+		return fmt.Errorf("unknown overflow policy %q (want drop-oldest or disconnect)", s)
+	}
+	return nil
+}
+
+// enqueue hands env to the client's writer without ever blocking the caller.
+func (c *client) enqueue(env *protocol.Envelope) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+
+	for {
+		select {
+		case c.send <- env:
+			return
+		default:
+		}
+
+		if c.srv.config().Overflow == DisconnectSlow {
+			c.srv.logger.Printf("[Server] Send queue full for '%s', disconnecting slow consumer", c.username)
+			c.close()
+			return
+		}
+
+		select {
+		case dropped := <-c.send:
+			c.srv.logger.Printf("[Server] Send queue full for '%s', dropped %s message %s", c.username, dropped.Type, dropped.ID)
+		default:
+		}
+	}
+}
+
+// writeLoop drains the client's send queue until the client is closed.
+func (c *client) writeLoop() {
+	for {
+		select {
+		case env := <-c.send:
+			if err := c.writeNow(env); err != nil {
+				c.srv.logger.Printf("Error sending to client %s: %v", c.username, err)
+				c.close()
+				return
+			}
+			if lastWords(env) {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// writeNow writes env directly to the connection, bounded by the configured
+// write timeout.
+func (c *client) writeNow(env *protocol.Envelope) error {
+	c.conn.SetWriteDeadline(time.Now().Add(c.srv.config().WriteTimeout))
+	return c.enc.Encode(env)
+}
+
+// lastWords reports whether env is the last thing a client is sent before
+// being disconnected.
+func lastWords(env *protocol.Envelope) bool {
+	if env.Type == protocol.TypeShutdown {
+		return true
+	}
+	return env.Type == protocol.TypeError && (env.Code == protocol.CodeKicked || env.Code == protocol.CodeBanned)
+}
+
+// hangUp sends a client on the list a final error and disconnects it once
+// the error is written, or after the write timeout if its queue is stuck.
+func (c *client) hangUp(code, text string) {
+	c.enqueue(errorMessage(code, text))
+	time.AfterFunc(c.srv.config().WriteTimeout, c.close)
+}
+
+// close stops the writer and closes the connection, which in turn ends the
+// client's read loop and sends it down the normal removing path.
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
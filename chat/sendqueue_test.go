@@ -0,0 +1,55 @@
+package chat
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/cameroncuttingedge/terminal-chat/chat/protocol"
+)
+
+// BenchmarkBroadcastToRoom fans a message out to n clients in a room, the
+// way the server delivers chat, with and without one client that never
+// reads. The stalled client's queue fills up and starts dropping, but the
+// cost per message should stay the same as with everyone reading.
+func BenchmarkBroadcastToRoom(b *testing.B) {
+	for _, stalled := range []bool{false, true} {
+		for _, n := range []int{10, 100, 1000} {
+			b.Run(fmt.Sprintf("clients=%d/stalled=%v", n, stalled), func(b *testing.B) {
+				benchmarkBroadcastToRoom(b, n, stalled)
+			})
+		}
+	}
+}
+
+func benchmarkBroadcastToRoom(b *testing.B, n int, stalled bool) {
+	s := NewServer(Config{Logger: log.New(io.Discard, "", 0)})
+	for i := 0; i < n; i++ {
+		conn, peer := net.Pipe()
+		c := &client{
+			srv:      s,
+			conn:     conn,
+			enc:      protocol.NewEncoder(conn),
+			send:     make(chan *protocol.Envelope, s.cfg.SendQueueSize),
+			done:     make(chan struct{}),
+			username: fmt.Sprintf("user%d", i),
+			room:     DefaultRoom,
+		}
+		s.clients = append(s.clients, c)
+		go c.writeLoop()
+		if i > 0 || !stalled {
+			go io.Copy(io.Discard, peer)
+		}
+		defer peer.Close()
+		defer c.close()
+	}
+
+	env := protocol.New(protocol.TypeChat, "hello, everyone")
+	env.Room = DefaultRoom
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.broadcastToRoom(DefaultRoom, env)
+	}
+}
@@ -1,255 +1,843 @@
 package chat
 
 import (
-	"bufio"
-	"flag"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/cameroncuttingedge/terminal-chat/util"
+	"github.com/cameroncuttingedge/terminal-chat/chat/accounts"
+	"github.com/cameroncuttingedge/terminal-chat/chat/bans"
+	"github.com/cameroncuttingedge/terminal-chat/chat/history"
+	"github.com/cameroncuttingedge/terminal-chat/chat/protocol"
 )
 
-type client struct {
-	conn     net.Conn
-	username string
-	color    string
+// ErrServerClosed is returned by Serve after Shutdown has been called.
+var ErrServerClosed = errors.New("chat: server closed")
+
+// DefaultColors is the palette handed out to users when Config.Colors is empty.
+var DefaultColors = []string{
+	"[#FFC0CB]",
+	"[#FD7E14]",
+	"[#28A745]",
+	"[#007BFF]",
+	"[#DC3545]",
+	"[#FFFF00]",
+	"[#C0C0C0X]",
+	"[#3498DB]",
+	"[#E74C3C]",
+	"[#2ECC71]",
+	"[#9B59B6]",
+	"[#D39E00]",
+	"[#000000]",
+}
+
+// Config holds the settings for a Server. Zero values fall back to defaults.
+// See Server.Reload for which settings can change while the server runs.
+type Config struct {
+	// Port is used by ListenAndServe; Serve ignores it.
+	Port int
+	// Listen lists the addresses ListenAndServe listens on, such as
+	// "127.0.0.1" or "[::1]:9000"; addresses without a port use Port.
+	// Defaults to every interface.
+	Listen []string
+	// TLSConfig makes ListenAndServe accept TLS connections only.
+	TLSConfig *tls.Config
+	// Logger receives the server's diagnostics. Defaults to the standard logger.
+	Logger *log.Logger
+	// Hooks are notified of server events.
+	Hooks Hooks
+
+	SendQueueSize     int
+	WriteTimeout      time.Duration
+	Overflow          OverflowPolicy
+	HeartbeatInterval time.Duration
+	// ClientTimeout is how long a client may go without sending anything,
+	// pongs included, before it is disconnected. Defaults to 30 seconds and
+	// is never shorter than two heartbeat intervals.
+	ClientTimeout time.Duration
+	// IdleAfter is how long a client may go without saying anything before
+	// it is shown as idle. Defaults to 5 minutes.
+	IdleAfter time.Duration
+	// Colors is the palette handed out to users, as color tags such as
+	// "[#FFC0CB]" or "[orange]".
+	Colors []string
+	// MOTD, the message of the day, is shown to users as they join. It may
+	// contain color tags.
+	MOTD string
+	// Rooms are listed by /rooms even when empty and show their topic to
+	// whoever enters them.
+	Rooms []Room
+
+	// Users holds registered accounts. When nil everyone joins as a guest.
+	Users *accounts.Store
+	// RequireAuth turns away anyone without a registered account.
+	RequireAuth bool
+	// Operators may moderate with /kick, /ban, /mute and /slowmode. Only
+	// registered accounts are trusted with the role, so these names need
+	// accounts in Users and cannot be claimed with /register.
+	Operators []string
+	// Bans keeps banned usernames and addresses. When nil bans are kept
+	// in memory until the server stops.
+	Bans *bans.Store
+
+	// History persists room messages. When nil nothing is kept.
+	History *history.Log
+	// ResumeWindow is how long a disconnected client's session, and with
+	// it its color, is kept for it to resume. Defaults to 10 minutes.
+	ResumeWindow time.Duration
+	// HistoryReplay is how many past messages a client is sent when it
+	// enters a room. It is capped at half of SendQueueSize so a replay can
+	// never overflow the queue. Defaults to 25.
+	HistoryReplay int
+
+	// MaxLineLength is the longest frame in bytes a client may send; longer
+	// ones are discarded as they are read. Defaults to 16 KiB.
+	MaxLineLength int
+	// MessageRate and MessageBurst limit each client to MessageRate frames
+	// a second on average, in bursts of at most MessageBurst. Default to 2
+	// and 10.
+	MessageRate  float64
+	MessageBurst int
+	// IPMessageRate and IPMessageBurst limit all clients from one address
+	// together the same way; opening a connection counts as a frame.
+	// Default to 5 and 30.
+	IPMessageRate  float64
+	IPMessageBurst int
+	// FloodMute is how long a client that keeps flooding after being
+	// warned is muted. Defaults to 1 minute.
+	FloodMute time.Duration
 }
 
-var (
-	clients     []client
-	adding      = make(chan client)
-	removing    = make(chan client)
-	messages    = make(chan string)
+// Hooks let embedders observe what happens on the server. They run on the
+// server's event goroutine and must not block.
+type Hooks struct {
+	OnJoin    func(username string)
+	OnLeave   func(username string)
+	OnMessage func(from, body string)
+}
+
+// Server is a chat server. Create one with NewServer.
+type Server struct {
+	// stats comes first so its counters are 64-bit aligned for atomic use
+	stats Stats
+
+	// cfg only changes in Reload, under cfgMu. Read what Reload can change
+	// through config().
+	cfg    Config
+	cfgMu  sync.RWMutex
+	logger *log.Logger
+
+	clients     []*client
+	adding      chan *client
+	removing    chan *client
+	messages    chan chatMessage
+	roomChanges chan roomChange
 	clientMux   sync.Mutex
-	usernameSet = make(map[string]bool) // Track usernames to ensure uniqueness
-	usedColors  = make(map[string]bool)
-	colors      = []string{
-		"[#FFC0CB]",
-		"[#FD7E14]",
-		"[#28A745]",
-		"[#007BFF]",
-		"[#DC3545]",
-		"[#FFFF00]",
-		"[#C0C0C0X]",
-		"[#3498DB]",
-		"[#E74C3C]",
-		"[#2ECC71]",
-		"[#9B59B6]",
-		"[#D39E00]",
-		"[#000000]",
+	usernameSet map[string]bool // Track usernames, by usernameKey, to ensure uniqueness
+	usedColors  map[string]bool
+	sessions    map[string]*session // by resume token
+	commands    *commandRegistry
+	mutes       map[string]time.Time     // by usernameKey, zero time for no end
+	slowModes   map[string]time.Duration // by room
+	addrLimits  addressLimits
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*client]struct{}
+	wg        sync.WaitGroup
+	startOnce sync.Once
+	quitOnce  sync.Once
+	quit      chan struct{}
+	// broadcastDone is closed once the event goroutine has stopped
+	broadcastDone chan struct{}
+}
+
+// chatMessage is something a client said, on its way to its room.
+type chatMessage struct {
+	sender *client
+	env    *protocol.Envelope
+}
+
+type client struct {
+	srv       *Server
+	conn      net.Conn
+	enc       *protocol.Encoder
+	send      chan *protocol.Envelope
+	done      chan struct{}
+	closeOnce sync.Once
+	username  string
+	color     string
+	room      string
+	version   int
+	ip        string
+	operator  bool
+	markup    bool // only touched by the client's own read loop
+
+	session     *session
+	resumeToken string // from the hello, if resuming
+	lastID      string // from the hello, last message the client saw
+	// added receives whether the broadcast goroutine took the client on;
+	// nothing after the hello is read until it does.
+	added chan bool
+
+	// Heartbeat state, guarded by clientMux
+	lastSeen time.Time
+	pingID   string
+	pingSent time.Time
+	rtt      time.Duration
+
+	// Presence, guarded by clientMux
+	lastActive time.Time
+	idle       bool
+	away       bool
+	awayReason string
+
+	// lastMessage is when the client last spoke, for slow mode. Guarded by
+	// clientMux.
+	lastMessage time.Time
+
+	// Flood protection, only touched by the client's own read loop
+	limit      *tokenBucket
+	strikes    int
+	lastStrike time.Time
+	warned     bool
+	// warnedMalformed is set once c has been told about a malformed frame,
+	// until its strikes decay like warned.
+	warnedMalformed bool
+}
+
+// NewServer returns a Server ready to Serve.
+func NewServer(cfg Config) *Server {
+	setDefaults(&cfg)
+	if cfg.Bans == nil {
+		cfg.Bans, _ = bans.Open("")
 	}
-)
 
-func broadcast() {
-	for {
-		select {
-		case msg := <-messages:
-			log.Printf("[Server] Received message to broadcast: %s", msg)
-			broadcastMessage(msg, "")
-		case newClient := <-adding:
-			prepareClientAddition(newClient)
-		case exClient := <-removing:
-			prepareClientRemoval(exClient)
-		}
+	return &Server{
+		cfg:         cfg,
+		logger:      cfg.Logger,
+		adding:      make(chan *client),
+		removing:    make(chan *client),
+		messages:    make(chan chatMessage),
+		roomChanges: make(chan roomChange),
+		usernameSet: make(map[string]bool),
+		usedColors:  make(map[string]bool),
+		sessions:    make(map[string]*session),
+		commands:    newCommandRegistry(),
+		mutes:       make(map[string]time.Time),
+		slowModes:   make(map[string]time.Duration),
+		addrLimits:  addressLimits{buckets: make(map[string]*addressBucket)},
+		listeners:   make(map[net.Listener]struct{}),
+		conns:       make(map[*client]struct{}),
+		quit:        make(chan struct{}),
+
+		broadcastDone: make(chan struct{}),
 	}
 }
 
-func prepareClientAddition(newClient client) {
-	clientMux.Lock()
-	if _, exists := usernameSet[newClient.username]; exists {
-		clientMux.Unlock() // Unlock before network I/O
-		log.Printf("[Server] Username %s is taken, sending UsernameTaken message", newClient.username)
-		fmt.Fprintln(newClient.conn, "SYSTEM_MESSAGE:UsernameTaken")
-		newClient.conn.Close()
-	} else {
-		usernameSet[newClient.username] = true
-		clients = append(clients, newClient)
-		clientMux.Unlock()
-		broadcastMessage(
-			fmt.Sprintf("Robot: %s%s[-] [red]has joined the chat.[-]", newClient.color, newClient.username),
-			"SYSTEM",
-		)
-		colorMessage := fmt.Sprintf("SYSTEM_MESSAGE:Color:%s", newClient.color)
-		fmt.Fprintln(newClient.conn, colorMessage)
+// ListenAndServe listens on Config.Listen, or all interfaces at Config.Port,
+// and serves, over TLS when Config.TLSConfig is set. It returns once serving
+// on any of the addresses stops.
+func (s *Server) ListenAndServe() error {
+	listeners, err := s.Listen()
+	if err != nil {
+		return err
 	}
+	return s.ServeListeners(listeners)
 }
 
-func prepareClientRemoval(exClient client) {
-	clientMux.Lock()
-	for i, c := range clients {
-		if c.conn == exClient.conn {
-			clients = append(clients[:i], clients[i+1:]...)
-			delete(usernameSet, exClient.username)
-			usedColors[exClient.color] = false
-			break
+// Listen opens the listeners ListenAndServe serves, so their addresses are
+// known before serving starts. Hand them to ServeListeners.
+func (s *Server) Listen() ([]net.Listener, error) {
+	addrs := s.cfg.Listen
+	if len(addrs) == 0 {
+		addrs = []string{"0.0.0.0"}
+	}
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), strconv.Itoa(s.cfg.Port))
 		}
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		if s.cfg.TLSConfig != nil {
+			listener = tls.NewListener(listener, s.cfg.TLSConfig)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// ServeListeners serves all of listeners until serving on any of them stops,
+// closing the rest unless the server was shut down.
+func (s *Server) ServeListeners(listeners []net.Listener) error {
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) { errs <- s.Serve(l) }(l)
+	}
+	err := <-errs
+	if err != ErrServerClosed {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	return err
+}
+
+// Addrs returns the addresses of the listeners being served, sorted, or none
+// before Serve has been called.
+func (s *Server) Addrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	addrs := make([]net.Addr, 0, len(s.listeners))
+	for l := range s.listeners {
+		addrs = append(addrs, l.Addr())
 	}
-	clientMux.Unlock()
-	broadcastMessage(fmt.Sprintf("Robot: %s has left the chat.", exClient.username), "SYSTEM")
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].String() < addrs[j].String() })
+	return addrs
 }
 
-func broadcastMessage(message string, messageType string) {
-	clientMux.Lock()
-	defer clientMux.Unlock()
+// Serve accepts connections on l until Shutdown is called. It may be called
+// on several listeners at once.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	select {
+	case <-s.quit:
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	default:
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+		l.Close()
+	}()
 
-	formattedMessage := formatMessage(message, messageType)
+	s.startOnce.Do(func() {
+		go func() {
+			defer close(s.broadcastDone)
+			s.broadcast()
+		}()
+		go s.startHeartbeat()
+	})
 
-	for _, c := range clients {
-		_, err := fmt.Fprintln(c.conn, formattedMessage)
+	for {
+		conn, err := l.Accept()
 		if err != nil {
-			log.Printf("Error broadcasting to client %s: %v", c.username, err)
-		} else {
-			log.Printf("[Server] Broadcasting message: %s to client: %s", formattedMessage, c.username)
+			select {
+			case <-s.quit:
+				return ErrServerClosed
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			s.logger.Println("Error accepting connection:", err)
+			continue
 		}
+		s.countStat(&s.stats.Connections)
+		go s.handleConnection(conn)
 	}
 }
 
-func formatMessage(message, messageType string) string {
-	if messageType == "SYSTEM" {
-		return fmt.Sprintf("[red]%s[-]", message)
-	} else {
-		parts := strings.SplitN(message, ": ", 2)
-		if len(parts) == 2 {
-			var userColor string
-			// Find the user's color
-			for _, c := range clients {
-				if c.username == parts[0] {
-					userColor = c.color
-					break
+// Notice tells clients why the server is shutting down.
+type Notice struct {
+	// Reason is shown to users. Defaults to "The server is shutting down."
+	Reason string
+	// Restart tells clients the server expects to be back shortly, so they
+	// should reconnect rather than give up.
+	Restart bool
+}
+
+// Shutdown is ShutdownWithNotice with the default notice.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.ShutdownWithNotice(ctx, Notice{})
+}
+
+// ShutdownWithNotice stops all listeners and sends every client a shutdown
+// frame carrying notice. Each connection is closed once its queue, the
+// notice included, has been written; whatever is still open when ctx
+// expires is closed at once. It returns after every connection handler and
+// the event goroutine have finished, or ctx.Err() if that took too long.
+func (s *Server) ShutdownWithNotice(ctx context.Context, notice Notice) error {
+	if notice.Reason == "" {
+		notice.Reason = "The server is shutting down."
+	}
+	bye := protocol.New(protocol.TypeShutdown, notice.Reason)
+	bye.Restart = notice.Restart
+
+	s.mu.Lock()
+	s.quitOnce.Do(func() { close(s.quit) })
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.mu.Unlock()
+	// The event goroutine may never have started
+	s.startOnce.Do(func() { close(s.broadcastDone) })
+
+	s.clientMux.Lock()
+	online := make(map[*client]bool, len(s.clients))
+	for _, c := range s.clients {
+		online[c] = true
+		c.enqueue(bye)
+		time.AfterFunc(s.config().WriteTimeout, c.close)
+	}
+	s.clientMux.Unlock()
+	s.logger.Printf("[Server] Shutting down, told %d clients: %s (restart: %t)", len(online), notice.Reason, notice.Restart)
+
+	s.mu.Lock()
+	for c := range s.conns {
+		if !online[c] {
+			// Still logging in, nothing to say to it
+			c.close()
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		<-s.broadcastDone
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for c := range s.conns {
+			c.close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (s *Server) broadcast() {
+	for {
+		select {
+		case said := <-s.messages:
+			msg := said.env
+			if msg.Room == "" {
+				// Nobody could receive it, so it is not counted or logged
+				s.logger.Printf("[Server] Dropping message from '%s' outside any room", msg.From)
+				continue
+			}
+			// Checked here rather than as the message is read, so a mute or
+			// slow mode applied while it was queued still stops it
+			if !s.maySpeak(said.sender, msg.Room) {
+				continue
+			}
+			s.logger.Printf("[Server] Received message to broadcast from '%s' in #%s: %s", msg.From, msg.Room, msg.Body)
+			s.broadcastToRoom(msg.Room, msg)
+			s.countStat(&s.stats.Messages)
+			if s.cfg.History != nil {
+				if err := s.cfg.History.Append(msg); err != nil {
+					s.logger.Printf("[Server] Failed to write history: %v", err)
 				}
 			}
-			if userColor == "" { // Default color if not found
-				userColor = "[white]"
+			if s.cfg.Hooks.OnMessage != nil {
+				s.cfg.Hooks.OnMessage(msg.From, msg.Body)
 			}
-			return fmt.Sprintf("%s%s[-]: %s", userColor, parts[0], parts[1])
+		case newClient := <-s.adding:
+			s.prepareClientAddition(newClient)
+		case exClient := <-s.removing:
+			s.prepareClientRemoval(exClient)
+		case change := <-s.roomChanges:
+			s.prepareRoomChange(change)
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+func (s *Server) prepareClientAddition(newClient *client) {
+	s.clientMux.Lock()
+	sess := s.resumableSession(newClient)
+	resumed := sess != nil
+	var replaced *client
+	if _, exists := s.usernameSet[usernameKey(newClient.username)]; exists {
+		if sess == nil || sess.client == nil {
+			s.clientMux.Unlock()
+			// The connection's own goroutine rejects it, so a slow peer
+			// cannot stall this one
+			newClient.added <- false
+			return
+		}
+		// The owner of the session is back before we noticed its old
+		// connection die; hand the session over to the new one.
+		replaced = sess.client
+		s.removeClientLocked(replaced)
+	}
+	s.usernameSet[usernameKey(newClient.username)] = true
+	if sess != nil {
+		newClient.color = sess.color
+		newClient.room = sess.room
+		newClient.away = sess.away
+		newClient.awayReason = sess.awayReason
+	} else {
+		s.assignColorToNewClient(newClient)
+		newClient.room = DefaultRoom
+		sess = s.newSession(newClient)
+	}
+	sess.client = newClient
+	newClient.session = sess
+	s.clients = append(s.clients, newClient)
+	s.clientMux.Unlock()
+
+	if replaced != nil {
+		s.logger.Printf("[Server] '%s' resumed its session on a new connection", newClient.username)
+		replaced.close()
+	}
+
+	go newClient.writeLoop()
+
+	welcome := protocol.New(protocol.TypeWelcome, "")
+	welcome.Version = newClient.version
+	welcome.Color = newClient.color
+	welcome.Room = newClient.room
+	welcome.Token = sess.token
+	welcome.Commands = s.commands.names(s, newClient)
+	newClient.enqueue(welcome)
+	// Only now may the client's frames be handled, and answered after the
+	// welcome
+	newClient.added <- true
+	s.replayMissed(newClient, newClient.room, newClient.lastID)
+	s.sendRoster(newClient, newClient.room)
+	if !resumed {
+		if motd := s.config().MOTD; motd != "" {
+			// The message of the day comes from the operator, who may style it
+			env := protocol.New(protocol.TypeSystem, motd)
+			env.Markup = true
+			newClient.enqueue(env)
 		}
-		// Fallback for unexpected message format
-		return message
+		s.sendTopic(newClient, newClient.room)
+	}
+
+	if replaced != nil {
+		// Nobody saw it leave, so nobody needs to see it join
+		return
+	}
+	joined := protocol.New(protocol.TypeJoin, "")
+	joined.From = newClient.username
+	joined.Color = newClient.color
+	joined.Room = newClient.room
+	s.broadcastToRoom(newClient.room, joined)
+	if s.cfg.Hooks.OnJoin != nil {
+		s.cfg.Hooks.OnJoin(newClient.username)
 	}
 }
 
-func assignColorToNewClient(newClient *client) {
+// removeClientLocked takes c off the client list, keeping its session for
+// the resume window. It reports whether c was on the list and must be called
+// with clientMux held.
+func (s *Server) removeClientLocked(c *client) bool {
+	for i, existing := range s.clients {
+		if existing == c {
+			s.clients = append(s.clients[:i], s.clients[i+1:]...)
+			delete(s.usernameSet, usernameKey(c.username))
+			s.detachSession(c)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) prepareClientRemoval(exClient *client) {
+	exClient.close()
+
+	s.clientMux.Lock()
+	found := s.removeClientLocked(exClient)
+	s.clientMux.Unlock()
+	if !found {
+		// Rejected during the handshake or replaced by a resumed
+		// connection; either way nobody needs to see it leave
+		return
+	}
+	left := protocol.New(protocol.TypeLeave, "")
+	left.From = exClient.username
+	left.Room = exClient.room
+	s.broadcastToRoom(exClient.room, left)
+	if s.cfg.Hooks.OnLeave != nil {
+		s.cfg.Hooks.OnLeave(exClient.username)
+	}
+}
+
+// replayHistory sends the client the most recent messages said in room,
+// marked as history.
+func (s *Server) replayHistory(c *client, room string) {
+	if s.cfg.History == nil {
+		return
+	}
+	for _, env := range s.cfg.History.Recent(room, s.config().HistoryReplay) {
+		replayed := *env
+		replayed.History = true
+		c.enqueue(&replayed)
+	}
+}
+
+// assignColorToNewClient must be called with clientMux held.
+func (s *Server) assignColorToNewClient(newClient *client) {
+	colors := s.config().Colors
 	// Try to find an unused color
 	for _, color := range colors {
-		if !usedColors[color] {
+		if !s.usedColors[color] {
 			newClient.color = color
-			usedColors[color] = true
+			s.usedColors[color] = true
 			return
 		}
 	}
-	newClient.color = colors[len(clients)%len(colors)]
+	newClient.color = colors[len(s.clients)%len(colors)]
 }
 
-func handleConnection(conn net.Conn) {
-	// Temporary client object; username will be set upon receiving the first message
-	newClient := client{conn: conn}
+// track registers a live connection so Shutdown can close it. It reports
+// false if the server is already shutting down.
+func (s *Server) track(c *client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.quit:
+		return false
+	default:
+	}
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
 
-	// Assign a color to the new client based on the current number of clients
-	assignColorToNewClient(&newClient)
+func (s *Server) untrack(c *client) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+	s.wg.Done()
+}
 
-	reader := bufio.NewReader(conn)
-	username, err := reader.ReadString('\n')
-	if err != nil {
-		log.Printf("Error during username read: %v", err)
+func (s *Server) handleConnection(conn net.Conn) {
+	cfg := s.config()
+	// Temporary client object; username will be set upon receiving the hello
+	newClient := &client{
+		srv:   s,
+		conn:  conn,
+		enc:   protocol.NewEncoder(conn),
+		send:  make(chan *protocol.Envelope, s.cfg.SendQueueSize),
+		done:  make(chan struct{}),
+		added: make(chan bool, 1),
+		ip:    remoteIP(conn),
+
+		lastSeen:   time.Now(),
+		lastActive: time.Now(),
+		limit:      newTokenBucket(cfg.MessageRate, cfg.MessageBurst),
+	}
+	if !s.track(newClient) {
 		conn.Close()
 		return
 	}
+	defer s.untrack(newClient)
 
-	username = strings.TrimSpace(username)
-	newClient.username = username
-	log.Printf("[Server] New client '%s' connected", newClient.username)
+	// Banned addresses are turned away before they can say anything
+	if ban := s.cfg.Bans.Find("", newClient.ip); ban != nil {
+		s.logger.Printf("[Server] Rejecting banned address %s", newClient.ip)
+		newClient.reject(protocol.CodeBanned, banMessage(ban))
+		return
+	}
+	if !s.connectFrom(newClient.ip) {
+		s.logger.Printf("[Server] Refusing connection from %s, connecting too often", newClient.ip)
+		s.countStat(&s.stats.RefusedConnections)
+		newClient.reject(protocol.CodeRateLimited, "Too many connections from your address, try again shortly.")
+		return
+	}
+	defer s.disconnectFrom(newClient.ip)
+
+	// Heartbeats only start after the hello, so a connection that never
+	// sends one must not be waited on for ever
+	conn.SetReadDeadline(time.Now().Add(cfg.ClientTimeout))
+	dec := protocol.NewDecoderSize(conn, cfg.MaxLineLength)
+	var hello protocol.Envelope
+	if err := dec.Decode(&hello); err != nil || hello.Type != protocol.TypeHello {
+		s.logger.Printf("Error during hello read: %v", err)
+		newClient.reject(protocol.CodeBadRequest, "Expected hello.")
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	version, err := protocol.Negotiate(hello.Version)
+	if err != nil {
+		s.logger.Printf("[Server] Rejecting client: %v", err)
+		newClient.reject(protocol.CodeUnsupportedVersion, err.Error())
+		return
+	}
 
-	adding <- newClient
+	username := strings.TrimSpace(hello.From)
+	if err := validateUsername(username); err != nil {
+		newClient.reject(protocol.CodeBadRequest, err.Error())
+		return
+	}
+	if ban := s.cfg.Bans.Find(username, ""); ban != nil {
+		s.logger.Printf("[Server] Rejecting banned user '%s' from %s", username, newClient.ip)
+		newClient.reject(protocol.CodeBanned, banMessage(ban))
+		return
+	}
+	registered, err := s.authenticate(username, hello.Password)
+	if err != nil {
+		var authErr *authError
+		if !errors.As(err, &authErr) {
+			s.logger.Printf("[Server] Failed to check login for '%s': %v", username, err)
+			authErr = &authError{protocol.CodeAuthFailed, "Could not check your login, please try again later."}
+		}
+		s.logger.Printf("[Server] Rejecting login for '%s': %s", username, authErr.code)
+		newClient.reject(authErr.code, authErr.message)
+		return
+	}
+	newClient.username = username
+	newClient.version = version
+	newClient.operator = registered && s.isOperator(username)
+	newClient.resumeToken = hello.Token
+	newClient.lastID = hello.LastID
+	s.logger.Printf("[Server] New client '%s' connected from %s with protocol v%d", newClient.username, newClient.ip, version)
+
+	select {
+	case s.adding <- newClient:
+	case <-s.quit:
+		newClient.close()
+		return
+	}
+	if !<-newClient.added {
+		s.logger.Printf("[Server] Username %s is taken, sending UsernameTaken message", newClient.username)
+		newClient.reject(protocol.CodeUsernameTaken, "Username already taken.")
+		return
+	}
 
-	log.Printf("New client connected: %s", newClient.username)
+	s.logger.Printf("New client connected: %s", newClient.username)
 
 	defer func() {
-		removing <- newClient
+		select {
+		case s.removing <- newClient:
+		case <-s.quit:
+			newClient.close()
+		}
 	}()
 
 	for {
-		message, err := reader.ReadString('\n')
-		log.Printf("[Server] Received raw message from '%s': %s", newClient.username, message)
+		var env protocol.Envelope
+		err := dec.Decode(&env)
+		if err == protocol.ErrMalformed {
+			// Garbage costs as much as a message, and more: it is a strike
+			if !s.allowFrame(newClient) {
+				continue
+			}
+			s.strike(newClient)
+			if !newClient.warnedMalformed {
+				newClient.warnedMalformed = true
+				s.logger.Printf("[Server] Dropping malformed frames from '%s'", newClient.username)
+				newClient.sendError(protocol.CodeBadRequest, "Malformed frame.")
+			}
+			continue
+		}
+		if err == protocol.ErrFrameTooLarge {
+			s.logger.Printf("[Server] Dropping oversized frame from '%s'", newClient.username)
+			s.countStat(&s.stats.TooLong)
+			newClient.sendError(protocol.CodeTooLong, fmt.Sprintf("Messages may be at most %d bytes.", cfg.MaxLineLength))
+			s.strike(newClient)
+			continue
+		}
 		if err != nil {
-			log.Printf("Error reading from client %s: %v", newClient.username, err)
+			s.logger.Printf("Error reading from client %s: %v", newClient.username, err)
 			break // Connection closed or error occurred
 		}
-		trimmedMessage := strings.TrimSpace(message)
-
-		messageContent := getMessageContentAfterColon(trimmedMessage)
+		s.logger.Printf("[Server] Received %s frame from '%s': %s", env.Type, newClient.username, s.redactSecrets(env.Body))
+		s.markSeen(newClient)
 
-		if strings.HasPrefix(messageContent, "!man") {
-			specialMessage := util.GetSpecialMessage("man")
-			sendMessageToClient(newClient, specialMessage)
+		if env.Type == protocol.TypePong {
+			s.recordPong(newClient, env.ID)
 			continue
-		} else if strings.HasPrefix(messageContent, "!party") {
-			specialMessage := util.GetSpecialMessage("party")
-			sendMessageToClient(newClient, specialMessage)
+		}
+		if !s.allowFrame(newClient) {
 			continue
 		}
-		log.Printf("[Server] Sending message from '%s' to channel: %s", newClient.username, trimmedMessage)
-		messages <- trimmedMessage
-		log.Printf("[Server] Message sent to channel from '%s'", newClient.username)
-	}
+		if env.Type != protocol.TypeChat {
+			// Unknown or unexpected types are ignored so newer clients keep working
+			continue
+		}
+		// Bodies may span several lines; they still make a single message
+		messageContent := strings.TrimSpace(strings.ReplaceAll(env.Body, "\r\n", "\n"))
+		if messageContent == "" {
+			continue
+		}
+		s.markActive(newClient)
 
-	log.Printf("Client disconnected: %s", newClient.username)
-}
+		if s.runCommand(newClient, messageContent) {
+			continue
+		}
 
-func getMessageContentAfterColon(message string) string {
-	if idx := strings.Index(message, ":"); idx != -1 {
-		return strings.TrimSpace(message[idx+1:])
+		// The sender always comes from the connection's own record; any name
+		// claimed in the frame is ignored so users cannot post as each other.
+		// Likewise the time is the server's, stamped as the message is
+		// accepted, so every client agrees on when it was said.
+		msg := protocol.New(protocol.TypeChat, messageContent)
+		msg.From = newClient.username
+		msg.Color = newClient.color
+		msg.Room = s.roomOf(newClient)
+		msg.Markup = newClient.markup
+
+		s.logger.Printf("[Server] Sending message from '%s' to channel: %s", newClient.username, messageContent)
+		select {
+		case s.messages <- chatMessage{newClient, msg}:
+		case <-s.quit:
+			return
+		}
+		s.logger.Printf("[Server] Message sent to channel from '%s'", newClient.username)
 	}
-	return message
-}
 
-func sendMessageToClient(c client, specialMessage string) {
-
-	fmt.Fprintln(c.conn, specialMessage)
+	s.logger.Printf("Client disconnected: %s", newClient.username)
 }
 
-func StartServer() {
-	port := flag.Int("port", 9999, "The port number on which the server listens")
-	flag.Parse()
-
-	portStr := fmt.Sprintf(":%d", *port)
-
-	listener, err := net.Listen("tcp", "0.0.0.0"+portStr)
-	if err != nil {
-		fmt.Println("Failed to start server:", err)
-		return
-	}
-
-	defer listener.Close()
+// alertColor is the color clients are asked to show alerts in, such as
+// moderation actions.
+const alertColor = "[red]"
 
-	localIP := util.GetLocalIP()
-	fmt.Printf("Server started on %s%s\n", localIP, portStr)
-	fmt.Printf("Clients can connect using: nc %s %d\n", localIP, *port)
-	fmt.Printf("Use these flags -ip=%s -port=%d\n", localIP, *port)
-
-	go broadcast()
-
-	go startHeartbeat()
+// alertMessage returns a system message that should stand out. Like every
+// system message its body is plain text; the color travels separately.
+func alertMessage(text string) *protocol.Envelope {
+	env := protocol.New(protocol.TypeSystem, text)
+	env.Color = alertColor
+	return env
+}
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			fmt.Println("Error accepting connection:", err)
-			continue
-		}
-		go handleConnection(conn)
-	}
+func errorMessage(code, text string) *protocol.Envelope {
+	env := protocol.New(protocol.TypeError, text)
+	env.Code = code
+	return env
 }
 
-func startHeartbeat() {
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+func (c *client) sendError(code, text string) {
+	c.enqueue(errorMessage(code, text))
+}
 
-	for {
-		<-ticker.C
-		broadcastMessage("SYSTEM_MESSAGE:PING", "SYSTEM")
+// reject writes a final error straight to a client that never made it onto
+// the client list, then hangs up.
+func (c *client) reject(code, text string) {
+	if err := c.writeNow(errorMessage(code, text)); err != nil {
+		c.srv.logger.Printf("Error rejecting client %s: %v", c.username, err)
 	}
+	c.close()
 }
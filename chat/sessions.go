@@ -0,0 +1,96 @@
+package chat
+
+import (
+	"time"
+
+	"github.com/cameroncuttingedge/terminal-chat/chat/protocol"
+)
+
+// session outlives a single connection so a client that drops off can come
+// back with the same color and room by presenting its resume token.
+type session struct {
+	token    string
+	username string
+	color    string
+	room     string
+	// away and awayReason survive a reconnect
+	away       bool
+	awayReason string
+	// client is the live connection, or nil while the session waits to be
+	// resumed.
+	client  *client
+	expires time.Time
+}
+
+// resumableSession returns the session newClient asked to resume, if it is
+// still valid. It must be called with clientMux held.
+func (s *Server) resumableSession(newClient *client) *session {
+	if newClient.resumeToken == "" {
+		return nil
+	}
+	sess, ok := s.sessions[newClient.resumeToken]
+	if !ok || sess.username != newClient.username {
+		return nil
+	}
+	return sess
+}
+
+// newSession starts a session for a client that is not resuming one. It must
+// be called with clientMux held.
+func (s *Server) newSession(c *client) *session {
+	sess := &session{
+		token:    protocol.NewID() + protocol.NewID(),
+		username: c.username,
+		color:    c.color,
+		room:     c.room,
+	}
+	s.sessions[sess.token] = sess
+	return sess
+}
+
+// detachSession keeps a departed client's session around for the resume
+// window. It must be called with clientMux held.
+func (s *Server) detachSession(c *client) {
+	if c.session == nil || c.session.client != c {
+		return
+	}
+	c.session.client = nil
+	c.session.room = c.room
+	c.session.away = c.away
+	c.session.awayReason = c.awayReason
+	c.session.expires = time.Now().Add(s.config().ResumeWindow)
+}
+
+// expireSessions forgets sessions whose resume window has passed and frees
+// their colors.
+func (s *Server) expireSessions() {
+	s.clientMux.Lock()
+	defer s.clientMux.Unlock()
+
+	now := time.Now()
+	for token, sess := range s.sessions {
+		if sess.client == nil && now.After(sess.expires) {
+			delete(s.sessions, token)
+			s.usedColors[sess.color] = false
+		}
+	}
+}
+
+// replayMissed sends a (re)connecting client what it missed in room since
+// lastID, or the usual recent history if that message is unknown.
+func (s *Server) replayMissed(c *client, room, lastID string) {
+	if s.cfg.History == nil {
+		return
+	}
+	if lastID != "" {
+		if missed, ok := s.cfg.History.Since(room, lastID, s.config().HistoryReplay); ok {
+			for _, env := range missed {
+				replayed := *env
+				replayed.History = true
+				c.enqueue(&replayed)
+			}
+			return
+		}
+	}
+	s.replayHistory(c, room)
+}
@@ -0,0 +1,67 @@
+package chat
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/cameroncuttingedge/terminal-chat/chat/protocol"
+)
+
+// Stats counts what the server has done since it started.
+type Stats struct {
+	// Connections is how many connections were accepted.
+	Connections uint64
+	// Messages is how many chat messages were broadcast.
+	Messages uint64
+	// RateLimited is how many frames were dropped for exceeding a rate limit.
+	RateLimited uint64
+	// TooLong is how many frames were discarded for exceeding MaxLineLength.
+	TooLong uint64
+	// RefusedConnections is how many connections were turned away because
+	// their address was connecting too often.
+	RefusedConnections uint64
+	// FloodMutes and FloodDisconnects count escalations against floods.
+	FloodMutes       uint64
+	FloodDisconnects uint64
+}
+
+// Stats returns a snapshot of the server's counters.
+func (s *Server) Stats() Stats {
+	return Stats{
+		Connections:        atomic.LoadUint64(&s.stats.Connections),
+		Messages:           atomic.LoadUint64(&s.stats.Messages),
+		RateLimited:        atomic.LoadUint64(&s.stats.RateLimited),
+		TooLong:            atomic.LoadUint64(&s.stats.TooLong),
+		RefusedConnections: atomic.LoadUint64(&s.stats.RefusedConnections),
+		FloodMutes:         atomic.LoadUint64(&s.stats.FloodMutes),
+		FloodDisconnects:   atomic.LoadUint64(&s.stats.FloodDisconnects),
+	}
+}
+
+// Online returns how many users are logged in.
+func (s *Server) Online() int {
+	s.clientMux.Lock()
+	defer s.clientMux.Unlock()
+	return len(s.clients)
+}
+
+func (s *Server) countStat(counter *uint64) {
+	atomic.AddUint64(counter, 1)
+}
+
+// cmdStats runs /stats.
+func cmdStats(s *Server, op *client, args []string) {
+	st := s.Stats()
+	s.clientMux.Lock()
+	online := len(s.clients)
+	s.clientMux.Unlock()
+
+	text := fmt.Sprintf("Stats:\n"+
+		"  %d online, %d connections accepted, %d refused\n"+
+		"  %d messages\n"+
+		"  %d frames rate limited, %d too long\n"+
+		"  %d muted and %d disconnected for flooding",
+		online, st.Connections, st.RefusedConnections, st.Messages,
+		st.RateLimited, st.TooLong, st.FloodMutes, st.FloodDisconnects)
+	op.enqueue(protocol.New(protocol.TypeSystem, text))
+}
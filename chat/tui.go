@@ -0,0 +1,777 @@
+package chat
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cameroncuttingedge/terminal-chat/alert"
+	chatclient "github.com/cameroncuttingedge/terminal-chat/chat/client"
+	"github.com/cameroncuttingedge/terminal-chat/chat/discovery"
+	"github.com/cameroncuttingedge/terminal-chat/chat/protocol"
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// maxInputLines is how tall the input grows while composing a multi-line
+// message.
+const maxInputLines = 6
+
+// userListWidth is the width of the user list sidebar, borders included.
+const userListWidth = 26
+
+// ChatUI encapsulates the UI elements of the chat application.
+type ChatUI struct {
+	App      *tview.Application
+	ChatView *tview.TextView
+	Input    *tview.TextArea
+	UserList *tview.TextView
+
+	root      *tview.Flex
+	body      *tview.Flex
+	showUsers bool
+	// users is the current room's roster. Only touched on the UI goroutine.
+	users map[string]chatclient.User
+
+	completeKey tcell.Key
+	completion  *completion
+	inputTitle  string
+	history     *inputHistory
+
+	matcher *mentionMatcher
+	// mentions are the region IDs of mention lines, oldest first, and
+	// mentionIndex the one being shown, or -1 while not browsing them.
+	mentions     []string
+	mentionIndex int
+
+	// lines is the scrollback the chat view is drawn from, timeFormat how
+	// their times are shown and lastDay the date of the last line drawn.
+	lines      []chatLine
+	timeFormat string
+	lastDay    string
+
+	// running is set, atomically, once App is about to run; lines must be
+	// queued to the UI goroutine from then on.
+	running int32
+}
+
+// localCommands are handled by the client itself rather than the server.
+var localCommands = []string{"/export", "/mentions"}
+
+var playSound bool
+var showNotifications bool
+
+func StartClient() {
+	log.Println("Starting client application...")
+	serverIP := flag.String("ip", "127.0.0.1", "The IP address of the server to connect to. When not given, pick a server found on the local network.")
+	serverPort := flag.String("port", "9999", "The port of the server to connect to.")
+	flag.BoolVar(&playSound, "sound", true, "Enable or disable sound (true/false)")
+	flag.BoolVar(&showNotifications, "notify", true, "Show desktop notifications for mentions and direct messages")
+	keywords := flag.String("keywords", "", "Comma separated words that alert you like an @mention")
+	useTLS := flag.Bool("tls", false, "Connect over TLS, pinning the server's certificate on first use")
+	repin := flag.Bool("repin", false, "Trust the server's certificate even if it differs from the pinned one")
+	completeKeyName := flag.String("complete-key", "Tab", "Key that completes usernames and commands in the input, e.g. Tab or Ctrl-Space")
+	timeFormat := flag.String("time-format", timeClock, "How message times are shown: clock, relative or off")
+	profileName := flag.String("profile", "", "Saved server profile to connect with, from the client config file")
+	discoveryPort := flag.Int("discovery-port", discovery.Port, "UDP port to look for servers on the local network on")
+	saveProfile := flag.String("save-profile", "", "Save the server, port, TLS setting and username you connect with as a profile of this name")
+
+	flag.Parse()
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	configPath, err := defaultClientConfigPath()
+	if err != nil {
+		log.Printf("Client config will not be loaded: %v", err)
+	}
+	settings, err := loadClientSettings(configPath)
+	if err != nil {
+		fmt.Printf("Failed to load client config: %v\n", err)
+		os.Exit(1)
+	}
+	settings.applyPreferences(set, keywords, completeKeyName, timeFormat)
+	if *profileName == "" {
+		*profileName = settings.Profile
+	}
+	if *profileName != "" && settings.Profiles[*profileName] == nil {
+		fmt.Printf("No profile named %q in %s\n", *profileName, configPath)
+		os.Exit(1)
+	}
+
+	completeKey, err := parseKey(*completeKeyName)
+	if err != nil {
+		fmt.Printf("Invalid -complete-key: %v\n", err)
+		os.Exit(1)
+	}
+	switch *timeFormat {
+	case timeClock, timeRelative, timeOff:
+	default:
+		fmt.Printf("Invalid -time-format %q: use clock, relative or off\n", *timeFormat)
+		os.Exit(1)
+	}
+
+	app := tview.NewApplication()
+
+	flagServer := endpoint{host: *serverIP, port: *serverPort, tls: *useTLS}
+	if !set["ip"] && *profileName == "" {
+		found, ok := showDiscoveryScreen(app, *discoveryPort, flagServer)
+		if !ok {
+			return
+		}
+		flagServer = found
+	}
+
+	// Show login screen and get credentials
+	serverFor := func(p *profile) endpoint { return flagServer.withProfile(p, set) }
+	username, password, chosen := showLoginScreen(app, settings, *profileName, serverFor)
+	chosenProfile := settings.Profiles[chosen]
+	srv := serverFor(chosenProfile)
+
+	clientConfig := chatclient.Config{Username: username, Password: password, TLS: srv.tls, Repin: *repin, Reconnect: true}
+	if chosenProfile != nil {
+		clientConfig.Fingerprint = chosenProfile.Fingerprint
+	}
+	if srv.tls {
+		pins, err := openPinStore()
+		if err != nil {
+			fmt.Printf("Failed to load pinned certificates: %v\n", err)
+			os.Exit(1)
+		}
+		clientConfig.Pins = pins
+	}
+
+	// Initialize the UI components
+	chatUI := setupUIComponents(app, clientConfig.Username)
+	chatUI.completeKey = completeKey
+	chatUI.timeFormat = *timeFormat
+	chatUI.matcher = newMentionMatcher(clientConfig.Username, strings.Split(*keywords, ","))
+	historyPath, err := defaultInputHistoryPath()
+	if err != nil {
+		log.Printf("Input history will not be saved: %v", err)
+	}
+	chatUI.history = loadInputHistory(historyPath)
+
+	// Pins are reported from the client's goroutine, while the app runs when
+	// reconnecting
+	pinNotice := func(text string) {
+		line := chatLine{text: text}
+		if atomic.LoadInt32(&chatUI.running) == 1 {
+			chatUI.App.QueueUpdateDraw(func() { chatUI.addLine(line) })
+		} else {
+			chatUI.addLine(line)
+		}
+	}
+	clientConfig.OnNewPin = func(addr, fingerprint string) {
+		pinNotice(fmt.Sprintf("[yellow]Trusting certificate for %s on first use.\nSHA-256 %s\nCheck that it matches the fingerprint printed by the server.[-]", addr, fingerprint))
+	}
+	clientConfig.OnPinError = func(addr string, err error) {
+		pinNotice(fmt.Sprintf("[red]Could not save the certificate for %s, it will be trusted on first use again next time: %s[-]", addr, tview.Escape(err.Error())))
+	}
+
+	onConnect := func(c *chatclient.Client) {
+		if chosenProfile != nil && chosenProfile.Room != "" && !sameRoom(chosenProfile.Room, c.Room()) {
+			if err := c.Join(chosenProfile.Room); err != nil {
+				log.Printf("Failed to join #%s: %v", chosenProfile.Room, err)
+			}
+		}
+		if *saveProfile != "" {
+			// The app is not running yet, so add the line directly
+			if err := settings.saveProfile(configPath, *saveProfile, srv, username); err != nil {
+				chatUI.addLine(chatLine{text: fmt.Sprintf("[red]Failed to save profile %s: %v[-]", *saveProfile, err)})
+			} else {
+				chatUI.addLine(chatLine{text: fmt.Sprintf("[yellow]Saved profile %s, connect with it using -profile=%s.[-]", *saveProfile, *saveProfile)})
+			}
+		}
+	}
+
+	// Connect to server and handle chat session
+	startChatSession(chatUI, srv.addr(), clientConfig, onConnect)
+}
+
+// sameRoom compares room names the way the server does.
+func sameRoom(a, b string) bool {
+	return strings.EqualFold(strings.TrimPrefix(a, "#"), strings.TrimPrefix(b, "#"))
+}
+
+func openPinStore() (*chatclient.PinStore, error) {
+	path, err := chatclient.DefaultPinStorePath()
+	if err != nil {
+		return nil, err
+	}
+	return chatclient.OpenPinStore(path)
+}
+
+func setupUIComponents(app *tview.Application, username string) *ChatUI {
+	chatUI := &ChatUI{
+		App:          app,
+		showUsers:    true,
+		users:        make(map[string]chatclient.User),
+		completeKey:  tcell.KeyTab,
+		mentionIndex: -1,
+		timeFormat:   timeClock,
+		lastDay:      time.Now().Format("2006-01-02"),
+	}
+
+	// Initialize the ChatView.
+	chatUI.ChatView = tview.NewTextView()
+	chatUI.ChatView.SetDynamicColors(true)
+	chatUI.ChatView.SetRegions(true)
+	chatUI.ChatView.SetScrollable(true)
+	chatUI.ChatView.SetBackgroundColor(tcell.ColorDefault)
+	chatUI.ChatView.SetBorder(true)
+	chatUI.ChatView.SetTitle(" Chat ")
+	chatUI.ChatView.SetChangedFunc(func() {
+		app.Draw()
+	})
+
+	// Initialize the Input.
+	chatUI.Input = tview.NewTextArea()
+	// Place holder until the client get the user color from the server
+	chatUI.Input.SetLabel(fmt.Sprintf("[red]%s[-]: ", plainText(username)))
+	chatUI.Input.SetPlaceholder("Alt+Enter or Ctrl+J starts a new line")
+	chatUI.Input.SetPlaceholderStyle(tcell.StyleDefault.Foreground(tcell.ColorGray))
+	chatUI.Input.SetTextStyle(tcell.StyleDefault)
+	chatUI.Input.SetLabelStyle(tcell.StyleDefault)
+	chatUI.Input.SetBackgroundColor(tcell.ColorDefault)
+	chatUI.Input.SetBorder(true)
+	chatUI.setInputTitle(" Input ")
+	chatUI.Input.SetChangedFunc(chatUI.fitInput)
+
+	// Initialize the UserList.
+	chatUI.UserList = tview.NewTextView()
+	chatUI.UserList.SetDynamicColors(true)
+	chatUI.UserList.SetScrollable(true)
+	chatUI.UserList.SetBackgroundColor(tcell.ColorDefault)
+	chatUI.UserList.SetBorder(true)
+	chatUI.UserList.SetTitle(" Users ")
+
+	// Setup the UI layout: chat and user list side by side above the input.
+	chatUI.body = tview.NewFlex().
+		AddItem(chatUI.ChatView, 0, 1, false).
+		AddItem(chatUI.UserList, userListWidth, 0, false)
+	chatUI.root = tview.NewFlex().
+		SetDirection(tview.FlexRow).
+		AddItem(chatUI.body, 0, 1, false).
+		AddItem(chatUI.Input, 3, 1, true)
+
+	app.SetRoot(chatUI.root, true).SetFocus(chatUI.Input)
+
+	app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyF6:
+			// Shift+F6 arrives as F18 on some terminals
+			chatUI.cycleFocus(event.Modifiers()&tcell.ModShift == 0)
+			return nil
+		case tcell.KeyF18:
+			chatUI.cycleFocus(false)
+			return nil
+		case tcell.KeyTab, tcell.KeyBacktab:
+			// In the input Tab usually completes; elsewhere it still
+			// moves focus.
+			if app.GetFocus() == chatUI.Input && chatUI.completeKey == tcell.KeyTab {
+				return event
+			}
+			chatUI.cycleFocus(event.Key() == tcell.KeyTab)
+			return nil
+		case tcell.KeyF2:
+			chatUI.toggleUserList()
+			return nil
+		case tcell.KeyF3:
+			chatUI.nextMention()
+			return nil
+		}
+		return event
+	})
+
+	return chatUI
+}
+
+func setupMessageSending(ui *ChatUI, c *chatclient.Client) {
+	ui.Input.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		if ui.handleCompletion(c, event) {
+			return nil
+		}
+		switch event.Key() {
+		case tcell.KeyEnter:
+			if event.Modifiers()&tcell.ModAlt != 0 {
+				// Alt+Enter starts a new line, which is what the text
+				// area does with a plain Enter
+				return tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone)
+			}
+			ui.sendInput(c)
+			return nil
+		case tcell.KeyCtrlJ:
+			return tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone)
+		case tcell.KeyEscape:
+			ui.leaveMentions()
+			return nil
+		case tcell.KeyUp:
+			// Recall history from the first line only, so the arrows
+			// still move around a multi-line draft
+			_, start, _ := ui.Input.GetSelection()
+			if !strings.Contains(ui.Input.GetText()[:start], "\n") {
+				if entry, ok := ui.history.prev(ui.Input.GetText()); ok {
+					ui.Input.SetText(entry, true)
+				}
+				return nil
+			}
+		case tcell.KeyDown:
+			_, _, end := ui.Input.GetSelection()
+			if !strings.Contains(ui.Input.GetText()[end:], "\n") {
+				if entry, ok := ui.history.next(); ok {
+					ui.Input.SetText(entry, true)
+				}
+				return nil
+			}
+		}
+		return event
+	})
+}
+
+// sendInput sends what is in the input and clears it.
+func (ui *ChatUI) sendInput(c *chatclient.Client) {
+	message := strings.TrimSpace(ui.Input.GetText())
+	if message == "" {
+		return
+	}
+	if message == "/mentions" {
+		ui.Input.SetText("", false)
+		ui.nextMention()
+		return
+	}
+	if message == "/export" || strings.HasPrefix(message, "/export ") {
+		ui.Input.SetText("", false)
+		ui.export(strings.TrimSpace(strings.TrimPrefix(message, "/export")))
+		return
+	}
+	ui.leaveMentions()
+	if isRegisterCommand(message) {
+		log.Println("Attempting to send /register command")
+	} else {
+		log.Printf("Attempting to send message: %s", message)
+	}
+	err := c.Send(message)
+	if err == chatclient.ErrNotConnected {
+		ui.addLine(chatLine{text: "[yellow]Not connected, message not sent.[-]"})
+		return
+	} else if err != nil {
+		log.Printf("Error sending message: %v", err)
+	} else {
+		log.Println("Message sent successfully")
+	}
+	ui.history.add(message)
+	ui.Input.SetText("", false)
+	alert.PlaySoundAsync("out.wav", playSound)
+}
+
+// fitInput grows the input with the number of lines typed, up to
+// maxInputLines.
+func (ui *ChatUI) fitInput() {
+	lines := strings.Count(ui.Input.GetText(), "\n") + 1
+	if lines > maxInputLines {
+		ui.root.ResizeItem(ui.Input, maxInputLines+2, 0)
+		return
+	}
+	ui.root.ResizeItem(ui.Input, lines+2, 0)
+	// The text area scrolled while it was still too small; everything fits
+	// now, so show it from the top.
+	ui.Input.SetOffset(0, 0)
+}
+
+// cycleFocus moves focus to the next, or previous, visible pane.
+func (ui *ChatUI) cycleFocus(forward bool) {
+	panes := []tview.Primitive{ui.Input, ui.ChatView}
+	if ui.showUsers {
+		panes = append(panes, ui.UserList)
+	}
+	current := 0
+	for i, p := range panes {
+		if ui.App.GetFocus() == p {
+			current = i
+		}
+	}
+	step := 1
+	if !forward {
+		step = len(panes) - 1
+	}
+	ui.App.SetFocus(panes[(current+step)%len(panes)])
+}
+
+// toggleUserList shows or hides the user list sidebar.
+func (ui *ChatUI) toggleUserList() {
+	ui.showUsers = !ui.showUsers
+	if ui.showUsers {
+		ui.body.AddItem(ui.UserList, userListWidth, 0, false)
+		return
+	}
+	ui.body.RemoveItem(ui.UserList)
+	if ui.App.GetFocus() == ui.UserList {
+		ui.App.SetFocus(ui.Input)
+	}
+}
+
+// renderUserList redraws the sidebar from ui.users. It must run on the UI
+// goroutine.
+func (ui *ChatUI) renderUserList() {
+	names := make([]string, 0, len(ui.users))
+	for name := range ui.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ui.UserList.Clear()
+	for _, name := range names {
+		u := ui.users[name]
+		line := fmt.Sprintf("%s%s[-]", u.Color, plainText(u.Name))
+		switch u.Status {
+		case protocol.StatusIdle:
+			line += " [gray](idle)[-]"
+		case protocol.StatusAway:
+			line += " [yellow](away)[-]"
+		}
+		if u.RTT > 0 {
+			line += fmt.Sprintf(" [gray]%dms[-]", u.RTT.Milliseconds())
+		}
+		fmt.Fprintln(ui.UserList, line)
+	}
+	ui.UserList.SetTitle(fmt.Sprintf(" Users (%d) ", len(names)))
+}
+
+// updateUsers applies change to the roster and redraws the sidebar from any
+// goroutine.
+func (ui *ChatUI) updateUsers(change func(users map[string]chatclient.User)) {
+	ui.App.QueueUpdateDraw(func() {
+		change(ui.users)
+		ui.renderUserList()
+	})
+}
+
+// notify shows a desktop notification unless they are turned off.
+func notify(title, body string) {
+	if !showNotifications {
+		return
+	}
+	go alert.ShowNotification(title, body)
+}
+
+// indentLines indents the continuation lines of a multi-line message so they
+// stand apart from the next sender's name.
+func indentLines(text string) string {
+	return strings.ReplaceAll(text, "\n", "\n    ")
+}
+
+// setInputTitle changes the input's title, which completion hints are shown
+// next to.
+func (ui *ChatUI) setInputTitle(title string) {
+	ui.inputTitle = title
+	ui.Input.SetTitle(title)
+}
+
+// setRoomTitle shows the current room in the chat view's border.
+func (ui *ChatUI) setRoomTitle(room string) {
+	ui.ChatView.SetTitle(fmt.Sprintf(" Chat - #%s ", room))
+}
+
+func handleIncomingEvents(c *chatclient.Client, ui *ChatUI, username string, pinnedByProfile bool) {
+	inHistory := false
+	// Who is away, to tell coming back from away apart from waking up
+	away := make(map[string]bool)
+	for ev := range c.Events() {
+		// Frame replayed history so it is not mistaken for live chat
+		if ev.History && !inHistory {
+			ui.printToChat("[gray]──── earlier messages ────[-]")
+		} else if !ev.History && inHistory {
+			ui.printToChat("[gray]──── now ────[-]")
+		}
+		inHistory = ev.History
+		// Servers stamp messages when they accept them; very old ones
+		// did not, so fall back to when the message arrived.
+		at := ev.Time
+		if at.IsZero() {
+			at = time.Now()
+		}
+
+		switch ev.Type {
+		case chatclient.EventError:
+			ui.printLine(at, fmt.Sprintf("[red]Error: %s[-]", plainText(ev.Body)))
+		case chatclient.EventColor:
+			color, room := ev.Color, ev.Room
+			ui.App.QueueUpdateDraw(func() {
+				ui.Input.SetLabel(fmt.Sprintf("%s%s[-]: ", color, plainText(username)))
+				ui.setRoomTitle(room)
+			})
+		case chatclient.EventSystem:
+			ui.printLine(at, systemText(ev.Body, ev.Color, ev.Markup))
+		case chatclient.EventRoster:
+			users := ev.Users
+			away = make(map[string]bool)
+			for _, u := range users {
+				away[u.Name] = u.Status == protocol.StatusAway
+			}
+			ui.updateUsers(func(m map[string]chatclient.User) {
+				for name := range m {
+					delete(m, name)
+				}
+				for _, u := range users {
+					m[u.Name] = u
+				}
+			})
+		case chatclient.EventPresence:
+			from, status := ev.From, ev.Status
+			if status == protocol.StatusAway {
+				away[from] = true
+				if ev.Body != "" {
+					ui.printLine(at, fmt.Sprintf("[red]Robot: %s is away: %s[-]", plainText(from), plainText(ev.Body)))
+				} else {
+					ui.printLine(at, fmt.Sprintf("[red]Robot: %s is away.[-]", plainText(from)))
+				}
+			} else if away[from] {
+				away[from] = false
+				ui.printLine(at, fmt.Sprintf("[red]Robot: %s is back.[-]", plainText(from)))
+			}
+			ui.updateUsers(func(m map[string]chatclient.User) {
+				if u, ok := m[from]; ok {
+					u.Status = status
+					m[from] = u
+				}
+			})
+		case chatclient.EventJoin:
+			joined := chatclient.User{Name: ev.From, Color: ev.Color, Status: protocol.StatusActive}
+			ui.updateUsers(func(m map[string]chatclient.User) {
+				if _, ok := m[joined.Name]; !ok {
+					m[joined.Name] = joined
+				}
+			})
+			if ev.From == username {
+				room := ev.Room
+				ui.App.QueueUpdateDraw(func() {
+					ui.setRoomTitle(room)
+				})
+			}
+			ui.printLine(at, fmt.Sprintf("[red]Robot: %s%s[-] [red]has joined #%s.[-]", ev.Color, plainText(ev.From), plainText(ev.Room)))
+		case chatclient.EventLeave:
+			from := ev.From
+			delete(away, from)
+			ui.updateUsers(func(m map[string]chatclient.User) {
+				delete(m, from)
+			})
+			ui.printLine(at, fmt.Sprintf("[red]Robot: %s has left #%s.[-]", plainText(ev.From), plainText(ev.Room)))
+		case chatclient.EventMessage:
+			// Only the color comes from the server's metadata; name and
+			// text are the user's and must never be read as tags.
+			from, body := plainText(ev.From), indentLines(messageText(ev.Body, ev.Markup))
+			mentioned := ev.From != username && ui.matcher.matches(ev.Body)
+			line := fmt.Sprintf("%s%s[-]: %s", ev.Color, from, body)
+			if ev.History {
+				line = fmt.Sprintf("[::d]%s[::-]", line)
+			}
+			if mentioned {
+				ui.printMention(at, line)
+			} else {
+				ui.printLine(at, line)
+			}
+			if ev.History || ev.From == username {
+				continue
+			}
+			if mentioned {
+				alert.PlaySoundAsync("mention.wav", playSound)
+				notify(fmt.Sprintf("%s mentioned you", ev.From), ev.Body)
+			} else {
+				alert.PlaySoundAsync("in.wav", playSound)
+			}
+		case chatclient.EventDirect:
+			body := indentLines(messageText(ev.Body, ev.Markup))
+			if ev.From == username {
+				ui.printLine(at, fmt.Sprintf("[violet]→ %s[-]: %s", plainText(ev.To), body))
+			} else {
+				alert.PlaySoundAsync("in.wav", playSound)
+				notify(fmt.Sprintf("Message from %s", ev.From), ev.Body)
+				ui.printLine(at, fmt.Sprintf("[violet]← %s[-]: %s", plainText(ev.From), body))
+			}
+		case chatclient.EventShutdown:
+			if ev.Restart {
+				ui.printLine(at, fmt.Sprintf("[yellow]Robot: %s It should be back shortly.[-]", plainText(ev.Body)))
+			} else {
+				ui.printLine(at, fmt.Sprintf("[red]Robot: %s[-]", plainText(ev.Body)))
+			}
+		case chatclient.EventReconnecting:
+			log.Printf("Reconnecting (attempt %d): %v", ev.Attempt, ev.Err)
+			var shutdown *chatclient.ShutdownError
+			if errors.As(ev.Err, &shutdown) {
+				// The shutdown notice already said why
+				ui.printLine(at, fmt.Sprintf("[yellow]Reconnecting in %s...[-]", ev.Delay))
+			} else {
+				ui.printLine(at, fmt.Sprintf("[yellow]Connection lost (%v). Reconnecting in %s...[-]", ev.Err, ev.Delay))
+			}
+			ui.App.QueueUpdateDraw(func() {
+				ui.setInputTitle(" Input (reconnecting) ")
+			})
+		case chatclient.EventReconnected:
+			color, room := ev.Color, ev.Room
+			ui.printLine(at, "[green]Reconnected.[-]")
+			ui.App.QueueUpdateDraw(func() {
+				ui.setInputTitle(" Input ")
+				ui.Input.SetLabel(fmt.Sprintf("%s%s[-]: ", color, plainText(username)))
+				ui.setRoomTitle(room)
+			})
+		case chatclient.EventDisconnected:
+			if ev.Err == nil {
+				return
+			}
+			log.Printf("Disconnected: %v", ev.Err)
+			var mismatch *chatclient.FingerprintMismatchError
+			if errors.As(ev.Err, &mismatch) {
+				ui.printLine(at, "[red]The server's certificate has changed, not reconnecting. Shutting down...[-]")
+				time.Sleep(3 * time.Second)
+				ui.App.Stop()
+				printFingerprintWarning(mismatch, pinnedByProfile)
+				return
+			}
+			reason := "Server connection lost."
+			var serverErr *chatclient.ServerError
+			var shutdown *chatclient.ShutdownError
+			if errors.As(ev.Err, &serverErr) {
+				reason = serverErr.Message
+			} else if errors.As(ev.Err, &shutdown) {
+				reason = "The server has shut down."
+			}
+			ui.printLine(at, fmt.Sprintf("[red]%s Shutting down...[-]", plainText(reason)))
+			time.Sleep(3 * time.Second)
+			ui.App.Stop()
+			fmt.Printf("%s Shutting down...\n", reason)
+		}
+	}
+}
+
+// startChatSession connects to addr and runs the chat until it ends.
+// onConnect runs once the connection is up, before the UI starts.
+func startChatSession(ui *ChatUI, addr string, cfg chatclient.Config, onConnect func(c *chatclient.Client)) {
+
+	// Connect to the mothership
+	c, err := chatclient.Dial(addr, cfg)
+	if err != nil {
+		var mismatch *chatclient.FingerprintMismatchError
+		if errors.As(err, &mismatch) {
+			printFingerprintWarning(mismatch, cfg.Fingerprint != "")
+			return
+		}
+		var serverErr *chatclient.ServerError
+		if errors.As(err, &serverErr) {
+			switch serverErr.Code {
+			case protocol.CodeUsernameTaken:
+				fmt.Println("Username already taken. Please restart the client and choose a different username.")
+			case protocol.CodeAuthFailed, protocol.CodeAuthRequired:
+				fmt.Printf("Login failed: %s\n", serverErr.Message)
+			default:
+				fmt.Printf("Server refused the connection: %s\n", serverErr.Message)
+			}
+			return
+		}
+		fmt.Printf("Failed to connect to server: %v\n", err)
+		return
+	}
+	defer c.Close()
+	onConnect(c)
+	go ui.refreshRelativeTimes()
+
+	// Setting up message sending functionality
+	setupMessageSending(ui, c)
+
+	// Handling incoming messages
+	go handleIncomingEvents(c, ui, cfg.Username, cfg.Fingerprint != "")
+
+	// Running the tview application
+	atomic.StoreInt32(&ui.running, 1)
+	if err := ui.App.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error running application: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// printFingerprintWarning explains a changed certificate. fromProfile says
+// the expected fingerprint came from the profile rather than
+// known_servers.json.
+func printFingerprintWarning(mismatch *chatclient.FingerprintMismatchError, fromProfile bool) {
+	fmt.Println("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+	fmt.Println("@    WARNING: SERVER CERTIFICATE HAS CHANGED!             @")
+	fmt.Println("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+	fmt.Println("Someone could be intercepting your connection, or the server")
+	fmt.Println("was reinstalled and generated a new certificate.")
+	fmt.Printf("Server:      %s\n", mismatch.Addr)
+	fmt.Printf("Pinned:      %s\n", mismatch.Pinned)
+	fmt.Printf("Presented:   %s\n", mismatch.Got)
+	fmt.Println("Ask the server operator for the fingerprint it prints at startup.")
+	if fromProfile {
+		fmt.Println("If it matches the presented one, update the fingerprint in your profile.")
+	} else {
+		fmt.Println("If it matches the presented one, reconnect with -repin.")
+	}
+}
+
+// showLoginScreen asks for a username and an optional password, offering the
+// saved profiles to pick from; selected is picked to begin with. An empty
+// password joins as a guest. It returns the chosen profile's name, empty for
+// none. serverFor tells which server a profile connects to.
+func showLoginScreen(app *tview.Application, settings *clientSettings, selected string, serverFor func(*profile) endpoint) (username, password, profileName string) {
+	usernameField := tview.NewInputField().
+		SetLabel("Username").
+		SetFieldWidth(20).
+		SetChangedFunc(func(text string) {
+			username = text
+		})
+	serverView := tview.NewTextView().SetLabel("Server").SetSize(1, 0).SetText(serverFor(nil).String())
+
+	form := tview.NewForm()
+	if names := settings.profileNames(); len(names) > 0 {
+		options := append([]string{"(none)"}, names...)
+		initial := 0
+		for i, name := range names {
+			if name == selected {
+				initial = i + 1
+			}
+		}
+		form.AddDropDown("Profile", options, initial, func(option string, index int) {
+			profileName = ""
+			if index > 0 {
+				profileName = option
+			}
+			p := settings.Profiles[profileName]
+			serverView.SetText(serverFor(p).String())
+			if p != nil && p.Username != "" {
+				usernameField.SetText(p.Username)
+			}
+		})
+	}
+	form.AddFormItem(serverView).
+		AddFormItem(usernameField).
+		AddPasswordField("Password", "", 20, '*', func(text string) {
+			password = text
+		}).
+		AddTextView("", "Leave the password empty to join as a guest.", 0, 1, true, false).
+		AddButton("Submit", func() {
+			app.Stop()
+		}).
+		SetCancelFunc(func() {
+			app.Stop()
+		})
+	form.SetBorder(true).SetTitle("Log in").SetTitleAlign(tview.AlignLeft).SetBackgroundColor(tcell.ColorDefault)
+	// Start on the profiles, or else the username; the server is only shown
+	if focus := form.GetFormItemIndex("Profile"); focus >= 0 {
+		form.SetFocus(focus)
+	} else {
+		form.SetFocus(form.GetFormItemIndex("Username"))
+	}
+
+	if err := app.SetRoot(form, true).SetFocus(form).Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error running application: %v\n", err)
+		os.Exit(1)
+	}
+
+	return username, password, profileName
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cameroncuttingedge/terminal-chat/chat"
+	"github.com/cameroncuttingedge/terminal-chat/chat/discovery"
+)
+
+// envPrefix names the environment variable that stands in for each flag, as
+// TERMINAL_CHAT_SEND_QUEUE does for -send-queue.
+const envPrefix = "TERMINAL_CHAT_"
+
+// settings holds everything the server can be configured with. Each setting
+// is a flag, can be set from the environment instead and, except for -config
+// and -add-user, from the config file. Flags win over the environment, which
+// wins over the file.
+type settings struct {
+	cfg chat.Config
+
+	configFile      string
+	listen          string
+	colors          string
+	usersFile       string
+	operators       string
+	bansFile        string
+	addUser         string
+	tlsCert         string
+	tlsKey          string
+	tlsSelfSigned   bool
+	historyFile     string
+	historyMax      int
+	historyMaxAge   time.Duration
+	shutdownTimeout time.Duration
+	expectRestart   bool
+	name            string
+	discovery       bool
+	discoveryPort   int
+}
+
+// restartOnly lists the settings that only take effect when the server
+// starts, so a reload leaves them alone.
+var restartOnly = []string{
+	"port", "listen", "send-queue", "users", "bans",
+	"tls-cert", "tls-key", "tls-self-signed",
+	"history", "history-max", "history-max-age",
+	"shutdown-timeout", "expect-restart",
+	"name", "discovery", "discovery-port",
+}
+
+func newFlagSet(s *settings, errorHandling flag.ErrorHandling) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], errorHandling)
+	fs.StringVar(&s.configFile, "config", "", "Path to a JSON config file; flags and environment variables override it")
+	fs.IntVar(&s.cfg.Port, "port", 9999, "The port number on which the server listens")
+	fs.StringVar(&s.listen, "listen", "", "Comma separated addresses to listen on, such as 127.0.0.1 or [::1]:9000; all interfaces when empty")
+	fs.IntVar(&s.cfg.SendQueueSize, "send-queue", 64, "Number of messages buffered per client before the overflow policy applies")
+	fs.Var(&s.cfg.Overflow, "overflow", "What to do when a client's send queue is full (drop-oldest or disconnect)")
+	fs.DurationVar(&s.cfg.WriteTimeout, "write-timeout", 10*time.Second, "How long a single write to a client may block")
+	fs.DurationVar(&s.cfg.HeartbeatInterval, "heartbeat", 5*time.Second, "How often clients are pinged")
+	fs.DurationVar(&s.cfg.IdleAfter, "idle-after", 5*time.Minute, "Show users as idle after they have been quiet this long")
+	fs.DurationVar(&s.cfg.ClientTimeout, "client-timeout", 30*time.Second, "Disconnect clients that send nothing, not even heartbeat replies, for this long")
+	fs.StringVar(&s.colors, "colors", "", "Comma separated colors handed out to users, such as orange or #FFC0CB; a built in palette when empty")
+	fs.StringVar(&s.cfg.MOTD, "motd", "", "Message of the day shown to users as they join")
+	fs.IntVar(&s.cfg.MaxLineLength, "max-line", 16*1024, "Longest message, in bytes, a client may send")
+	fs.Float64Var(&s.cfg.MessageRate, "rate", 2, "Messages per second each client may send on average")
+	fs.IntVar(&s.cfg.MessageBurst, "burst", 10, "Messages each client may send in a quick burst")
+	fs.Float64Var(&s.cfg.IPMessageRate, "ip-rate", 5, "Messages and new connections per second all clients from one address may send on average")
+	fs.IntVar(&s.cfg.IPMessageBurst, "ip-burst", 30, "Messages and new connections all clients from one address may send in a quick burst")
+	fs.DurationVar(&s.cfg.FloodMute, "flood-mute", time.Minute, "How long clients that keep flooding after a warning are muted")
+	fs.StringVar(&s.usersFile, "users", "", "Path to the registered accounts file; accounts are disabled when empty")
+	fs.BoolVar(&s.cfg.RequireAuth, "require-auth", false, "Only accept registered accounts, no guests")
+	fs.StringVar(&s.operators, "operators", "", "Comma separated registered usernames allowed to kick, ban, mute and set slow mode")
+	fs.StringVar(&s.bansFile, "bans", "bans.json", "Path to the bans file; bans are kept in memory only when empty")
+	fs.StringVar(&s.addUser, "add-user", "", "Register this username (prompts for a password) and exit")
+	fs.StringVar(&s.tlsCert, "tls-cert", "", "TLS certificate file; enables TLS together with -tls-key")
+	fs.StringVar(&s.tlsKey, "tls-key", "", "TLS private key file")
+	fs.StringVar(&s.historyFile, "history", "", "Path to the message history log; history is disabled when empty")
+	fs.IntVar(&s.cfg.HistoryReplay, "history-replay", 25, "How many past messages to replay to clients entering a room")
+	fs.IntVar(&s.historyMax, "history-max", 1000, "How many messages the history log retains")
+	fs.DurationVar(&s.historyMaxAge, "history-max-age", 30*24*time.Hour, "How long the history log retains messages")
+	fs.BoolVar(&s.tlsSelfSigned, "tls-self-signed", false, "Enable TLS, generating a self-signed certificate at -tls-cert/-tls-key on first run")
+	fs.DurationVar(&s.shutdownTimeout, "shutdown-timeout", 5*time.Second, "How long to let clients receive their last messages when stopping")
+	fs.BoolVar(&s.expectRestart, "expect-restart", false, "Tell clients the server will be back when it is stopped, e.g. under a supervisor that restarts it, so they reconnect")
+	fs.StringVar(&s.name, "name", "", "Name clients on the local network see when looking for servers; defaults to the host name")
+	fs.BoolVar(&s.discovery, "discovery", true, "Answer clients looking for servers on the local network")
+	fs.IntVar(&s.discoveryPort, "discovery-port", discovery.Port, "UDP port to answer clients looking for servers on")
+	return fs
+}
+
+// loadSettings parses args, then fills in whatever they leave unset from the
+// environment and then from the config file. It returns the flag set too so
+// values can be compared between loads.
+func loadSettings(args []string, errorHandling flag.ErrorHandling) (*settings, *flag.FlagSet, error) {
+	s := &settings{}
+	fs := newFlagSet(s, errorHandling)
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, ok := os.LookupEnv(envName(f.Name))
+		if set[f.Name] || !ok || envErr != nil {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			envErr = fmt.Errorf("%s: %v", envName(f.Name), err)
+		}
+		set[f.Name] = true
+	})
+	if envErr != nil {
+		return nil, nil, envErr
+	}
+
+	if s.configFile != "" {
+		if err := s.readConfigFile(fs, set); err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", s.configFile, err)
+		}
+	}
+	return s, fs, nil
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// readConfigFile applies the config file to every setting not in set. The
+// file is a JSON object keyed by flag name, plus "rooms":
+//
+//	{
+//	  "port": 9999,
+//	  "motd": "Welcome!",
+//	  "colors": ["orange", "#FFC0CB"],
+//	  "rooms": [{"name": "random", "topic": "Anything goes"}]
+//	}
+//
+// Lists may also be given as comma separated strings, like their flags.
+func (s *settings) readConfigFile(fs *flag.FlagSet, set map[string]bool) error {
+	data, err := os.ReadFile(s.configFile)
+	if err != nil {
+		return err
+	}
+	var file map[string]json.RawMessage
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+
+	for key, raw := range file {
+		if key == "rooms" {
+			if err := json.Unmarshal(raw, &s.cfg.Rooms); err != nil {
+				return fmt.Errorf("rooms: %v", err)
+			}
+			continue
+		}
+		if key == "config" || key == "add-user" || fs.Lookup(key) == nil {
+			return fmt.Errorf("unknown setting %q", key)
+		}
+		if set[key] {
+			continue
+		}
+		value, err := flagValue(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		if err := fs.Set(key, value); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// flagValue turns a JSON value into the text its flag would be given.
+func flagValue(raw json.RawMessage) (string, error) {
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		return strings.Join(list, ","), nil
+	}
+	var value interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return "", err
+	}
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number, bool:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("expected a string, number, boolean or list of strings")
+	}
+}
+
+// config returns the chat settings, without any of the stores, or an error
+// for settings that cannot work.
+func (s *settings) config() (chat.Config, error) {
+	cfg := s.cfg
+	cfg.Listen = splitList(s.listen)
+	for _, color := range splitList(s.colors) {
+		cfg.Colors = append(cfg.Colors, "["+strings.Trim(color, "[]")+"]")
+	}
+	cfg.Operators = splitList(s.operators)
+
+	if cfg.RequireAuth && s.usersFile == "" {
+		return cfg, fmt.Errorf("-require-auth needs -users to point at an accounts file")
+	}
+	if len(cfg.Operators) > 0 && s.usersFile == "" {
+		return cfg, fmt.Errorf("-operators needs -users to point at an accounts file")
+	}
+	return cfg, nil
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(text string) []string {
+	var list []string
+	for _, item := range strings.Split(text, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// changedRestartOnly lists the restart only settings whose values differ
+// between two loads.
+func changedRestartOnly(before, after *flag.FlagSet) []string {
+	var changed []string
+	for _, name := range restartOnly {
+		if before.Lookup(name).Value.String() != after.Lookup(name).Value.String() {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
@@ -1,14 +1,281 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/cameroncuttingedge/terminal-chat/chat"
+	"github.com/cameroncuttingedge/terminal-chat/chat/accounts"
+	"github.com/cameroncuttingedge/terminal-chat/chat/bans"
+	"github.com/cameroncuttingedge/terminal-chat/chat/certs"
+	"github.com/cameroncuttingedge/terminal-chat/chat/discovery"
+	"github.com/cameroncuttingedge/terminal-chat/chat/history"
+	"github.com/cameroncuttingedge/terminal-chat/chat/protocol"
+	"github.com/cameroncuttingedge/terminal-chat/util"
+	"golang.org/x/term"
 )
 
 func main() {
-	chat.StartServer()
+	opts, flags, err := loadSettings(os.Args[1:], flag.ExitOnError)
+	if err != nil {
+		fmt.Println("Failed to load settings:", err)
+		os.Exit(1)
+	}
+	cfg, err := opts.config()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if opts.usersFile != "" {
+		users, err := accounts.Open(opts.usersFile)
+		if err != nil {
+			fmt.Println("Failed to load accounts:", err)
+			os.Exit(1)
+		}
+		cfg.Users = users
+	}
+
+	if opts.addUser != "" {
+		if cfg.Users == nil {
+			fmt.Println("-add-user needs -users to point at an accounts file")
+			os.Exit(1)
+		}
+		if err := registerFromTerminal(cfg.Users, opts.addUser); err != nil {
+			fmt.Println("Failed to register user:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Registered %s\n", opts.addUser)
+		return
+	}
+
+	if err := cfg.Validate(); err != nil {
+		fmt.Println("Invalid settings:", err)
+		os.Exit(1)
+	}
+	warnMissingOperators(cfg)
+
+	banList, err := bans.Open(opts.bansFile)
+	if err != nil {
+		fmt.Println("Failed to load bans:", err)
+		os.Exit(1)
+	}
+	cfg.Bans = banList
+
+	tlsCert, tlsKey := opts.tlsCert, opts.tlsKey
+	if opts.tlsSelfSigned {
+		if tlsCert == "" {
+			tlsCert = "server-cert.pem"
+		}
+		if tlsKey == "" {
+			tlsKey = "server-key.pem"
+		}
+	}
+	var fingerprint string
+	if tlsCert != "" || tlsKey != "" {
+		var cert tls.Certificate
+		var err error
+		if opts.tlsSelfSigned {
+			cert, err = certs.LoadOrCreate(tlsCert, tlsKey)
+		} else {
+			cert, err = tls.LoadX509KeyPair(tlsCert, tlsKey)
+		}
+		if err != nil {
+			fmt.Println("Failed to load TLS certificate:", err)
+			os.Exit(1)
+		}
+		cfg.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		fingerprint = certs.LeafFingerprint(cert)
+	}
+
+	if opts.historyFile != "" {
+		historyLog, err := history.Open(opts.historyFile, history.Options{MaxMessages: opts.historyMax, MaxAge: opts.historyMaxAge})
+		if err != nil {
+			fmt.Println("Failed to open history log:", err)
+			os.Exit(1)
+		}
+		defer historyLog.Close()
+		cfg.History = historyLog
+	}
+
+	server := chat.NewServer(cfg)
+	listeners, err := server.Listen()
+	if err != nil {
+		fmt.Println("Failed to start server:", err)
+		os.Exit(1)
+	}
+	var addrs []net.Addr
+	for _, l := range listeners {
+		addrs = append(addrs, l.Addr())
+	}
+
+	// Point clients at an address they can reach, with the port actually
+	// listened on, which -listen may have chosen
+	ip, port := util.GetLocalIP(), 0
+	if p, ok := networkPort(addrs); ok {
+		port = p
+	} else if tcp, ok := addrs[0].(*net.TCPAddr); ok {
+		ip, port = tcp.IP.String(), tcp.Port
+	}
+	if len(cfg.Listen) > 0 {
+		var bound []string
+		for _, addr := range addrs {
+			bound = append(bound, addr.String())
+		}
+		fmt.Printf("Server started on %s\n", strings.Join(bound, ", "))
+	} else {
+		fmt.Printf("Server started on %s:%d\n", ip, port)
+	}
+	if cfg.TLSConfig != nil {
+		fmt.Printf("TLS certificate fingerprint (SHA-256): %s\n", fingerprint)
+		fmt.Printf("Use these flags -ip=%s -port=%d -tls\n", ip, port)
+	} else {
+		fmt.Printf("Use these flags -ip=%s -port=%d\n", ip, port)
+	}
+
+	if _, ok := networkPort(addrs); opts.discovery && !ok {
+		fmt.Println("Only listening on loopback, so clients on the local network will not find this server.")
+	} else if opts.discovery {
+		responder, err := advertise(server, opts.name, cfg, opts.discoveryPort)
+		if err != nil {
+			fmt.Println("Clients on the local network will not find this server:", err)
+		} else {
+			defer responder.Close()
+			fmt.Println("Clients on the local network can find this server without -ip.")
+		}
+	}
+
+	stopped := make(chan struct{})
+	go stopOnSignal(server, opts.shutdownTimeout, opts.expectRestart, stopped)
+	go reloadOnSignal(server, flags, cfg.Users)
+
+	if err := server.ServeListeners(listeners); err != chat.ErrServerClosed {
+		fmt.Println("Failed to start server:", err)
+		return
+	}
+	<-stopped
+}
+
+// stopOnSignal shuts the server down gracefully on SIGINT or SIGTERM and
+// closes stopped when done. A second signal exits at once.
+func stopOnSignal(server *chat.Server, timeout time.Duration, restart bool, stopped chan<- struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	go func() {
+		<-signals
+		fmt.Println("Stopping now.")
+		os.Exit(1)
+	}()
+
+	notice := chat.Notice{Reason: "The server is shutting down."}
+	if restart {
+		notice = chat.Notice{Reason: "The server is restarting.", Restart: true}
+	}
+	fmt.Printf("Received %s, telling clients and shutting down (press Ctrl-C again to stop now)...\n", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.ShutdownWithNotice(ctx, notice); err != nil {
+		fmt.Println("Some clients were cut off:", err)
+	}
+	st := server.Stats()
+	log.Printf("[Server] Stopped after %d connections and %d messages", st.Connections, st.Messages)
+	fmt.Println("Server stopped.")
+	close(stopped)
+}
+
+// advertise answers clients looking for servers on the local network with
+// the port of a listener they can reach.
+func advertise(server *chat.Server, name string, cfg chat.Config, port int) (*discovery.Responder, error) {
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	responder, err := discovery.Listen(port)
+	if err != nil {
+		return nil, err
+	}
+	id := protocol.NewID()
+	go responder.Serve(func() (discovery.Announcement, bool) {
+		port, ok := networkPort(server.Addrs())
+		if !ok {
+			return discovery.Announcement{}, false
+		}
+		return discovery.Announcement{ID: id, Name: name, Port: port, Users: server.Online(), TLS: cfg.TLSConfig != nil}, true
+	})
+	return responder, nil
+}
+
+// networkPort returns the port of the first listener that is not bound to
+// loopback, and false if there is none.
+func networkPort(addrs []net.Addr) (int, bool) {
+	for _, addr := range addrs {
+		if tcp, ok := addr.(*net.TCPAddr); ok && !tcp.IP.IsLoopback() {
+			return tcp.Port, true
+		}
+	}
+	return 0, false
+}
+
+// reloadOnSignal reloads the settings on SIGHUP and applies whatever can
+// change without a restart. Settings that fail to load or validate are
+// reported and leave the server as it was.
+func reloadOnSignal(server *chat.Server, flags *flag.FlagSet, users *accounts.Store) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		opts, next, err := loadSettings(os.Args[1:], flag.ContinueOnError)
+		if err == nil {
+			var cfg chat.Config
+			if cfg, err = opts.config(); err == nil {
+				cfg.Users = users
+				err = server.Reload(cfg)
+				if err == nil {
+					warnMissingOperators(cfg)
+				}
+			}
+		}
+		if err != nil {
+			fmt.Println("Not reloading settings:", err)
+			log.Printf("[Server] Not reloading settings: %v", err)
+			continue
+		}
+		fmt.Println("Reloaded settings.")
+		for _, name := range changedRestartOnly(flags, next) {
+			fmt.Printf("Changing -%s takes a restart, still using %s\n", name, flags.Lookup(name).Value)
+		}
+	}
+}
+
+// warnMissingOperators points out operators without an account, who could
+// not log in as one.
+func warnMissingOperators(cfg chat.Config) {
+	for _, name := range cfg.Operators {
+		if !cfg.Users.Exists(name) {
+			fmt.Printf("Operator %s has no account yet; create it with -add-user %s\n", name, name)
+		}
+	}
+}
+
+// registerFromTerminal prompts for a password without echoing it and
+// registers username with it.
+func registerFromTerminal(users *accounts.Store, username string) error {
+	fmt.Printf("Password for %s: ", username)
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return err
+	}
+	return users.Register(username, string(password))
 }
 
 func init() {
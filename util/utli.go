@@ -7,7 +7,7 @@ import (
 func GetSpecialMessage(action string) string {
 	switch action {
 	case "man":
-		return "Robot: To scroll through the chat, use the arrow keys or your mouse wheel. To focus on the input section, press Tab."
+		return "To scroll through the chat, use the arrow keys or your mouse wheel. Press F6 (or Shift+F6) to move between the input, the chat and the user list, and F2 to show or hide the user list. Tab completes names and commands."
 	case "party":
 		return `
 ░░░░░░░░▄▄▄▀▀▀▄▄███▄░░░░░░░░░░░░░░